@@ -0,0 +1,155 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes one dictionary entry of a struct type.
+type field struct {
+	name      string
+	index     []int
+	tagged    bool // the name comes from a tag
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the dictionary layout of the struct type t, sorted by
+// key as bencode requires.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+
+	// Sort by name, then depth, then tagged first, so that the field
+	// dominating each name comes first in its run.
+	all := typeFields(t, nil)
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		return a.tagged && !b.tagged
+	})
+
+	var fields []field
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].name == all[i].name {
+			j++
+		}
+		if f, ok := dominantField(all[i:j]); ok {
+			fields = append(fields, f)
+		}
+		i = j
+	}
+
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]field)
+}
+
+// dominantField picks the field that a name refers to among fields, which
+// share that name and are sorted as in cachedFields. As in encoding/json, the
+// shallowest field wins, and among fields at the same depth a single tagged
+// one; otherwise the name is ambiguous and no field is encoded under it.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) &&
+		fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+	return fields[0], true
+}
+
+// lookupField finds the field named key in fields.
+func lookupField(fields []field, key string) *field {
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// typeFields walks the exported fields of t. The fields of untagged embedded
+// structs are promoted into the parent; conflicts between names are left to
+// cachedFields.
+func typeFields(t reflect.Type, index []int) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts := parseTag(tag)
+
+		idx := make([]int, len(index)+1)
+		copy(idx, index)
+		idx[len(index)] = i
+
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, typeFields(sf.Type, idx)...)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		tagged := name != ""
+		if !tagged {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     idx,
+			tagged:    tagged,
+			omitEmpty: opts.contains("omitempty"),
+		})
+	}
+	return fields
+}
+
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.Index(tag, ","); i != -1 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+func (opts tagOptions) contains(name string) bool {
+	s := string(opts)
+	for s != "" {
+		var next string
+		if i := strings.Index(s, ","); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == name {
+			return true
+		}
+		s = next
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// fuzzSeeds are packets of the kinds a DHT node and a metadata exchange
+// read from the network.
+var fuzzSeeds = []string{
+	// KRPC, BEP 5
+	"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+	"d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+	"d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe",
+	"d1:rd2:id20:0123456789abcdefghij5:nodes26:mnopqrstuvwxyz123456\x01\x02\x03\x04\x1a\xe1e1:t2:aa1:y1:re",
+	"d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe",
+	"d2:ip6:\x01\x02\x03\x04\x1a\xe11:rd2:id20:abcdefghij01234567895:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+	"d1:ad2:id20:abcdefghij012345678912:implied_porti1e9:info_hash20:mnopqrstuvwxyz1234564:porti6881e5:token8:aoeusnthe1:q13:announce_peer1:t2:aa1:y1:qe",
+	"d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+
+	// ut_metadata, BEP 9: handshake, request, data with the piece after the
+	// dictionary, and reject
+	"d1:md11:ut_metadatai3ee13:metadata_sizei31235ee",
+	"d8:msg_typei0e5:piecei0ee",
+	"d8:msg_typei1e5:piecei0e10:total_sizei8ee\x01\x02\x03\x04\x05\x06\x07\x08",
+	"d8:msg_typei2e5:piecei0ee",
+
+	// edge cases
+	"i-0e",
+	"i-9223372036854775809e",
+	"01:a",
+	"d1:bi1e1:ai2ee",
+	"9999999999999999999:",
+	"llllllllllllllllllllllllllllllllllllllllllee",
+	"",
+}
+
+// fuzzOptions are the decoders every input goes through.
+var fuzzOptions = []DecoderOptions{
+	{},
+	{Strict: true},
+	{MaxDepth: 8, MaxStringLength: 1024, MaxItems: 64, MaxSize: 512},
+}
+
+// checkDecodeError fails unless err is one of the errors malformed or
+// oversized input may yield when decoding into an interface. The only type
+// error possible there is an integer beyond the range of int64, which is
+// well-formed bencode that no interface value can hold.
+func checkDecodeError(t *testing.T, err error) {
+	t.Helper()
+	switch e := err.(type) {
+	case nil, *SyntaxError, *LimitError:
+	case *UnmarshalTypeError:
+		if !strings.HasPrefix(e.Value, "integer ") || e.Type != reflect.TypeOf(int64(0)) {
+			t.Fatalf("unexpected type error: %v", err)
+		}
+	default:
+		t.Fatalf("unexpected error %T: %v", err, err)
+	}
+}
+
+// krpcMessage has the shape of a KRPC packet, to exercise decoding into
+// structs alongside decoding into interfaces.
+type krpcMessage struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	Q string     `bencode:"q"`
+	A RawMessage `bencode:"a"`
+	R struct {
+		ID     [20]byte `bencode:"id"`
+		Nodes  []byte   `bencode:"nodes"`
+		Values []string `bencode:"values"`
+	} `bencode:"r"`
+	E  []interface{} `bencode:"e"`
+	IP []byte        `bencode:"ip"`
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, opts := range fuzzOptions {
+			var v interface{}
+			err := opts.Unmarshal(data, &v)
+			checkDecodeError(t, err)
+			if err != nil {
+				continue
+			}
+
+			// Anything decoded encodes again, and canonical input
+			// encodes back to itself.
+			out, err := Marshal(v)
+			if err != nil {
+				t.Fatalf("Marshal of decoded %q: %v", data, err)
+			}
+			if opts.Strict && !bytes.Equal(out, data) {
+				t.Fatalf("strict input %q encodes back as %q", data, out)
+			}
+			if opts.Strict && !Valid(data) {
+				t.Fatalf("strict input %q is not Valid", data)
+			}
+
+			var msg krpcMessage
+			switch err := opts.Unmarshal(data, &msg).(type) {
+			case nil, *UnmarshalTypeError:
+			default:
+				t.Fatalf("decoding %q into a struct: %T: %v", data, err, err)
+			}
+		}
+
+		if Valid(data) {
+			var v interface{}
+			switch err := Unmarshal(data, &v).(type) {
+			case *SyntaxError, *LimitError:
+				t.Fatalf("Valid input %q: %v", data, err)
+			}
+		}
+	})
+}
+
+// decodeAll reads values from dec until it fails, and returns what it read
+// and the error it stopped on.
+func decodeAll(t *testing.T, dec *Decoder, limit int) ([][]byte, error) {
+	var values [][]byte
+	last := dec.InputOffset()
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err != nil {
+			return values, err
+		}
+		if off := dec.InputOffset(); off <= last || off > int64(limit) {
+			t.Fatalf("offset went from %d to %d in %d bytes", last, off, limit)
+		}
+		last = dec.InputOffset()
+
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal of decoded value: %v", err)
+		}
+		values = append(values, out)
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Add([]byte(fuzzSeeds[0] + fuzzSeeds[1] + fuzzSeeds[2]))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, opts := range fuzzOptions {
+			values, err := decodeAll(t, opts.NewDecoder(bytes.NewReader(data)), len(data))
+			if err != io.EOF {
+				checkDecodeError(t, err)
+			}
+
+			// A reader that is not a ByteScanner is buffered, which must
+			// not change what is decoded.
+			buffered, err2 := decodeAll(t, opts.NewDecoder(iotest.OneByteReader(bytes.NewReader(data))), len(data))
+			if len(buffered) != len(values) || (err == io.EOF) != (err2 == io.EOF) {
+				t.Fatalf("buffered decoder read %d values and stopped on %v, want %d and %v", len(buffered), err2, len(values), err)
+			}
+			for i := range values {
+				if !bytes.Equal(buffered[i], values[i]) {
+					t.Fatalf("value %d is %q buffered, %q unbuffered", i, buffered[i], values[i])
+				}
+			}
+		}
+	})
+}
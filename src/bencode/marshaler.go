@@ -1,187 +1,346 @@
 package bencode
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
 	"strconv"
 )
 
+// An UnsupportedTypeError is returned by Marshal when attempting to encode a
+// value of a type bencode cannot represent.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// An UnsupportedValueError is returned by Marshal when attempting to encode a
+// nil pointer or interface outside of a dictionary.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
+// Marshal returns the bencoding of data.
+//
+// Integers and booleans (as 0 or 1) encode as bencode integers, strings,
+// byte slices and byte arrays as bencode strings, other slices and arrays as
+// lists, and maps with string keys and structs as dictionaries.
+//
+// Struct fields are encoded under their name unless the field's tag says
+// otherwise, as in encoding/json:
+//
+//	InfoHash []byte `bencode:"info_hash"`       // key "info_hash"
+//	Token    string `bencode:"token,omitempty"` // dropped when empty
+//	Ignored  int    `bencode:"-"`               // never encoded
+//
+// The fields of an untagged embedded struct are promoted into the parent.
+// Where several fields share a key, the least nested wins, then a tagged one;
+// if that still leaves more than one, none of them is encoded.
+//
+// Types implementing Marshaler, such as RawMessage, are written as the
+// bencode their MarshalBencode method returns.
+//
+// Dictionary keys are always written in raw byte order, so the output is
+// canonical: equal values encode to identical bytes. Nil pointers and
+// interfaces and empty RawMessages inside a dictionary are left out, since
+// bencode has no null value.
 func Marshal(data interface{}) ([]byte, error) {
-	result := make([]byte, 512) // WTF
-	length, _, err := marshal(data, &result, 0, 512)
-	if err != nil {
+	var buf bytes.Buffer
+	e := &encodeState{w: &buf}
+	if err := e.marshal(data); err != nil {
 		return nil, err
 	}
 
-	return result[:length], nil
+	return buf.Bytes(), nil
+}
+
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
 }
 
-func marshal(data interface{}, result *[]byte, offset int, length int) (int, int, error) {
+// encodeState writes bencode to w. Write errors of a bufio.Writer are sticky
+// and reported by Flush, so the individual writes are not checked.
+type encodeState struct {
+	w       writer
+	scratch [64]byte
+}
+
+func (e *encodeState) marshal(data interface{}) error {
 	switch value := data.(type) {
 	case int64:
-		offset, length = marshalInt(value, result, offset, length)
+		e.marshalInt(value)
+	case int32:
+		e.marshalInt(int64(value))
+	case int16:
+		e.marshalInt(int64(value))
+	case int8:
+		e.marshalInt(int64(value))
+	case int:
+		e.marshalInt(int64(value))
+	case uint64:
+		e.marshalUint(value)
+	case uint32:
+		e.marshalUint(uint64(value))
+	case uint16:
+		e.marshalUint(uint64(value))
+	case uint8:
+		e.marshalUint(uint64(value))
+	case uint:
+		e.marshalUint(uint64(value))
+	case []byte:
+		e.marshalBytes(value)
+	case string:
+		e.marshalString(value)
+	case []interface{}:
+		return e.marshalList(value)
+	case map[string]interface{}:
+		return e.marshalDictionary(value)
+	default:
+		return e.marshalValue(reflect.ValueOf(data))
+	}
 
-		return offset, length, nil
+	return nil
+}
 
-	case int32:
-		offset, length = marshalInt(int64(value), result, offset, length)
+func (e *encodeState) marshalValue(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedValueError{v, "nil"}
+	}
 
-		return offset, length, nil
+	if v.Type().Implements(marshalerType) && !isNilValue(v) {
+		return e.marshalMarshaler(v.Interface().(Marshaler), v.Type())
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		return e.marshalMarshaler(v.Addr().Interface().(Marshaler), v.Type())
+	}
 
-	case int16:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	switch v.Kind() {
+	case reflect.Bool:
+		var i int64
+		if v.Bool() {
+			i = 1
+		}
+		e.marshalInt(i)
 
-		return offset, length, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.marshalInt(v.Int())
 
-	case int8:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.marshalUint(v.Uint())
 
-		return offset, length, nil
+	case reflect.String:
+		e.marshalString(v.String())
 
-	case int:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.marshalBytes(v.Bytes())
+			break
+		}
 
-		return offset, length, nil
+		return e.marshalSequence(v)
 
-	case uint64:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(buf), v)
+			e.marshalBytes(buf)
+			break
+		}
 
-		return offset, length, nil
+		return e.marshalSequence(v)
 
-	case uint32:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{v.Type()}
+		}
 
-		return offset, length, nil
+		return e.marshalMap(v)
 
-	case uint16:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	case reflect.Struct:
+		return e.marshalStruct(v)
 
-		return offset, length, nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedValueError{v, "nil " + v.Type().String()}
+		}
 
-	case uint8:
-		offset, length = marshalInt(int64(value), result, offset, length)
+		return e.marshalValue(v.Elem())
 
-		return offset, length, nil
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
 
-	case uint:
-		offset, length = marshalInt(int64(value), result, offset, length)
+	return nil
+}
 
-		return offset, length, nil
+func (e *encodeState) marshalMarshaler(m Marshaler, t reflect.Type) error {
+	data, err := m.MarshalBencode()
+	if err != nil {
+		return &MarshalerError{t, err}
+	}
 
-	case []byte:
-		offset, length = marshalBytes(value, result, offset, length)
+	if !Valid(data) {
+		return &MarshalerError{t, errors.New("invalid bencode")}
+	}
 
-		return offset, length, nil
+	e.w.Write(data)
 
-	case string:
-		offset, length = marshalBytes([]byte(value), result, offset, length)
+	return nil
+}
 
-		return offset, length, nil
+func (e *encodeState) marshalInt(data int64) {
+	e.w.WriteByte('i')
+	e.w.Write(strconv.AppendInt(e.scratch[:0], data, 10))
+	e.w.WriteByte('e')
+}
 
-	case []interface{}:
-		return marshalList(value, result, offset, length)
+func (e *encodeState) marshalUint(data uint64) {
+	e.w.WriteByte('i')
+	e.w.Write(strconv.AppendUint(e.scratch[:0], data, 10))
+	e.w.WriteByte('e')
+}
 
-	case map[string]interface{}:
-		return marshalDictionary(value, result, offset, length)
+func (e *encodeState) marshalBytes(data []byte) {
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(data)), 10))
+	e.w.WriteByte(':')
+	e.w.Write(data)
+}
 
-	default:
-		return 0, 0, fmt.Errorf("bencode: unsupported type: %T", value)
-	}
+func (e *encodeState) marshalString(data string) {
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(data)), 10))
+	e.w.WriteByte(':')
+	e.w.WriteString(data)
 }
 
-func prepareBuffer(result *[]byte, offset int, length int, neededLength int) int {
-	availableLength := length - offset
-	if availableLength >= neededLength {
-		return length
-	}
+func (e *encodeState) marshalList(data []interface{}) error {
+	e.w.WriteByte('l')
 
-	rate := 1
-	for availableLength < neededLength {
-		rate++
-		availableLength = length*rate - offset
+	for _, data := range data {
+		if err := e.marshal(data); err != nil {
+			return err
+		}
 	}
 
-	if rate > 1 {
-		newResult := make([]byte, length*rate)
-		copy(newResult, (*result)[:length])
-		length *= rate
-		*result = newResult
-	}
+	e.w.WriteByte('e')
 
-	return length
+	return nil
 }
 
-func marshalInt(data int64, result *[]byte, offset int, length int) (int, int) {
-	intBuffer := []byte(strconv.FormatInt(data, 10))
-	intBufferLength := len(intBuffer)
-	length = prepareBuffer(result, offset, length, intBufferLength+2)
+func (e *encodeState) marshalDictionary(data map[string]interface{}) error {
+	e.w.WriteByte('d')
+
+	keys := make([]string, 0, len(data))
+	for key, value := range data {
+		if value == nil || isAbsentValue(reflect.ValueOf(value)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	(*result)[offset] = 'i'
-	offset++
-	copy((*result)[offset:], intBuffer)
-	offset += intBufferLength
-	(*result)[offset] = 'e'
-	offset++
+	for _, key := range keys {
+		e.marshalString(key)
+		if err := e.marshal(data[key]); err != nil {
+			return err
+		}
+	}
 
-	return offset, length
+	e.w.WriteByte('e')
+
+	return nil
 }
 
-func marshalBytes(data []byte, result *[]byte, offset int, length int) (int, int) {
-	dataLength := len(data)
-	lengthBuffer := []byte(strconv.Itoa(dataLength))
-	lengthBufferLength := len(lengthBuffer)
-	length = prepareBuffer(result, offset, length, lengthBufferLength+1+dataLength)
+func (e *encodeState) marshalSequence(v reflect.Value) error {
+	e.w.WriteByte('l')
 
-	copy((*result)[offset:], lengthBuffer)
-	offset += lengthBufferLength
-	(*result)[offset] = ':'
-	offset++
-	copy((*result)[offset:], data)
-	offset += dataLength
+	for i := 0; i < v.Len(); i++ {
+		if err := e.marshalValue(v.Index(i)); err != nil {
+			return err
+		}
+	}
 
-	return offset, length
+	e.w.WriteByte('e')
+
+	return nil
 }
 
-func marshalList(data []interface{}, result *[]byte, offset int, length int) (int, int, error) {
-	length = prepareBuffer(result, offset, length, 1)
+func (e *encodeState) marshalMap(v reflect.Value) error {
+	e.w.WriteByte('d')
 
-	(*result)[offset] = 'l'
-	offset++
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
 
-	for _, data := range data {
-		var err error
-		offset, length, err = marshal(data, result, offset, length)
-		if err != nil {
-			return 0, 0, err
+	for _, key := range keys {
+		elem := v.MapIndex(key)
+		if isAbsentValue(elem) {
+			continue
 		}
-	}
 
-	length = prepareBuffer(result, offset, length, 1)
+		e.marshalString(key.String())
+		if err := e.marshalValue(elem); err != nil {
+			return err
+		}
+	}
 
-	(*result)[offset] = 'e'
-	offset++
+	e.w.WriteByte('e')
 
-	return offset, length, nil
+	return nil
 }
 
-func marshalDictionary(data map[string]interface{}, result *[]byte, offset int, length int) (int, int, error) {
-	length = prepareBuffer(result, offset, length, 1)
+func (e *encodeState) marshalStruct(v reflect.Value) error {
+	e.w.WriteByte('d')
 
-	(*result)[offset] = 'd'
-	offset++
+	for _, f := range cachedFields(v.Type()) {
+		elem := v.FieldByIndex(f.index)
+		if isAbsentValue(elem) || f.omitEmpty && isEmptyValue(elem) {
+			continue
+		}
 
-	for key, data := range data {
-		offset, length = marshalBytes([]byte(key), result, offset, length)
-		var err error
-		offset, length, err = marshal(data, result, offset, length)
-		if err != nil {
-			return 0, 0, err
+		e.marshalString(f.name)
+		if err := e.marshalValue(elem); err != nil {
+			return err
 		}
 	}
 
-	length = prepareBuffer(result, offset, length, 1)
+	e.w.WriteByte('e')
+
+	return nil
+}
 
-	(*result)[offset] = 'e'
-	offset++
+// isNilValue reports whether v is a nil pointer or interface, or an
+// interface holding a nil pointer, none of which bencode can represent.
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		return v.IsNil()
+	case reflect.Interface:
+		return v.IsNil() || isNilValue(v.Elem())
+	}
+	return false
+}
 
-	return offset, length, nil
+// isAbsentValue reports whether v is left out of a dictionary: a nil value as
+// in isNilValue, or an empty RawMessage, which holds no value either.
+func isAbsentValue(v reflect.Value) bool {
+	if isNilValue(v) {
+		return true
+	}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	return v.Type() == rawMessageType && v.Len() == 0
 }
@@ -0,0 +1,146 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type inner struct {
+	A int    `bencode:"a"`
+	B string `bencode:"shadowed"`
+}
+
+type outer struct {
+	inner
+	Shadowed string `bencode:"shadowed"`
+	C        int    `bencode:"c"`
+}
+
+// duplicate tags at the same depth cancel out
+type duplicate struct {
+	A int `bencode:"x"`
+	B int `bencode:"x"`
+	C int
+}
+
+type left struct {
+	Shared int `bencode:"shared"`
+	L      int `bencode:"l"`
+	Name   int `bencode:"Name"`
+}
+
+type right struct {
+	Shared int `bencode:"shared"`
+	R      int `bencode:"r"`
+	Name   int
+}
+
+// twoEmbeds promotes "shared" twice, which is ambiguous, and "Name" twice,
+// where the tagged one wins.
+type twoEmbeds struct {
+	left
+	right
+}
+
+type tagged struct {
+	InfoHash [4]byte          `bencode:"info_hash"`
+	Token    string           `bencode:"token,omitempty"`
+	Port     int              `bencode:"port,omitempty"`
+	Want     []string         `bencode:"want,omitempty"`
+	Ignored  int              `bencode:"-"`
+	Ptr      *int             `bencode:"ptr"`
+	Iface    interface{}      `bencode:"iface"`
+	Raw      RawMessage       `bencode:"raw,omitempty"`
+	Map      map[string]int64 `bencode:"map,omitempty"`
+	Untagged bool
+	private  int
+}
+
+type withRaw struct {
+	A RawMessage `bencode:"a"`
+	B int        `bencode:"b"`
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalBencode() ([]byte, error) {
+	return []byte("i1"), nil
+}
+
+func TestMarshal(t *testing.T) {
+	seven := 7
+	for _, c := range []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"int", 42, "i42e"},
+		{"negative", int8(-3), "i-3e"},
+		{"uint64", uint64(1 << 63), "i9223372036854775808e"},
+		{"bool", true, "i1e"},
+		{"string", "spam", "4:spam"},
+		{"bytes", []byte{0, 0xff}, "2:\x00\xff"},
+		{"byte array", [4]byte{1, 2, 3, 4}, "4:\x01\x02\x03\x04"},
+		{"empty string", "", "0:"},
+		{"list", []interface{}{1, "a", []interface{}{}}, "li1e1:alee"},
+		{"int slice", []int{1, 2}, "li1ei2ee"},
+		{"int array", [2]int{3, 4}, "li3ei4ee"},
+		{"dictionary", map[string]interface{}{"b": 1, "a": "x"}, "d1:a1:x1:bi1ee"},
+		{"raw byte order", map[string]int{"b": 1, "B": 2, "a": 3, "aa": 4}, "d1:Bi2e1:ai3e2:aai4e1:bi1ee"},
+		{"nil in dictionary", map[string]interface{}{"a": 1, "b": nil}, "d1:ai1ee"},
+		{"nil pointer in dictionary", map[string]interface{}{"a": (*int)(nil)}, "de"},
+		{"nil pointer in typed map", map[string]*int{"a": nil, "b": &seven}, "d1:bi7ee"},
+		{"pointer", &seven, "i7e"},
+		{"raw message", RawMessage("li1ee"), "li1ee"},
+		{"empty raw message in struct", withRaw{B: 1}, "d1:bi1ee"},
+		{"empty raw message in dictionary", map[string]interface{}{"a": RawMessage{}}, "de"},
+		{
+			"struct",
+			tagged{InfoHash: [4]byte{'a', 'b', 'c', 'd'}, Port: 6881, Ignored: 1, private: 2},
+			"d8:Untaggedi0e9:info_hash4:abcd4:porti6881ee",
+		},
+		{
+			"struct with values",
+			tagged{Token: "t", Want: []string{"n4"}, Ptr: &seven, Iface: "x", Raw: RawMessage("de"),
+				Map: map[string]int64{"k": 1}, Untagged: true},
+			"d8:Untaggedi1e5:iface1:x9:info_hash4:\x00\x00\x00\x003:mapd1:ki1ee3:ptri7e3:rawde5:token1:t4:wantl2:n4ee",
+		},
+		{"embedded", outer{inner{1, "hidden"}, "shown", 2}, "d1:ai1e1:ci2e8:shadowed5:showne"},
+	} {
+		got, err := Marshal(c.v)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		v    interface{}
+		err  interface{}
+	}{
+		{"nil", nil, new(*UnsupportedValueError)},
+		{"nil pointer", (*int)(nil), new(*UnsupportedValueError)},
+		{"nil in list", []interface{}{nil}, new(*UnsupportedValueError)},
+		{"int keys", map[int]int{1: 1}, new(*UnsupportedTypeError)},
+		{"channel", make(chan int), new(*UnsupportedTypeError)},
+		{"float", 1.5, new(*UnsupportedTypeError)},
+		{"empty raw message", []interface{}{RawMessage(nil)}, new(*MarshalerError)},
+		{"invalid marshaler", []interface{}{badMarshaler{}}, new(*MarshalerError)},
+	} {
+		_, err := Marshal(c.v)
+		if err == nil {
+			t.Errorf("%s: no error", c.name)
+			continue
+		}
+		if !errors.As(err, c.err) {
+			t.Errorf("%s: got %T: %v, want %v", c.name, err, err, reflect.TypeOf(c.err).Elem())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+)
+
+// Marshaler is the interface implemented by types that can marshal
+// themselves into valid bencode.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is the interface implemented by types that can unmarshal a
+// bencoded value of themselves. UnmarshalBencode receives the exact bytes of
+// one value and must copy them if it wishes to keep them.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// A MarshalerError is returned by Marshal when a MarshalBencode method fails
+// or produces invalid bencode.
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "bencode: error calling MarshalBencode for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	rawMessageType  = reflect.TypeOf(RawMessage(nil))
+)
+
+// RawMessage is a raw encoded bencode value. Decoding into a RawMessage
+// captures the exact bytes of the value, and encoding one writes them back
+// verbatim, so a sub-value can be kept byte-for-byte, hashed, or decoded
+// later. An empty RawMessage holds no value: it is left out of dictionaries
+// like a nil pointer, and cannot be encoded anywhere else.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencoding of m.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("empty RawMessage")
+	}
+
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data.
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// Valid reports whether data is exactly one well-formed bencoded value.
+func Valid(data []byte) bool {
+	r := bytes.NewReader(data)
+	d := &decodeState{r: r, opts: DecoderOptions{MaxDepth: maxDepth}}
+	_, err := d.valueInterface()
+
+	return err == nil && r.Len() == 0
+}
+
+// rawValue consumes the next value and returns its exact bytes.
+func (d *decodeState) rawValue() ([]byte, error) {
+	var buf bytes.Buffer
+	d.record = &buf
+	_, err := d.valueInterface()
+	d.record = nil
+
+	return buf.Bytes(), err
+}
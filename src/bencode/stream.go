@@ -0,0 +1,109 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+)
+
+// An Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode writes the bencoding of v to the stream. Large values are written
+// out as they are encoded, so a failing Encode may leave a partial value
+// behind.
+func (enc *Encoder) Encode(v interface{}) error {
+	e := &encodeState{w: enc.w}
+	if err := e.marshal(v); err != nil {
+		return err
+	}
+
+	return enc.w.Flush()
+}
+
+// A Decoder reads bencoded values from an input stream.
+type Decoder struct {
+	r    byteReader
+	buf  *bufio.Reader
+	off  int64
+	opts DecoderOptions
+}
+
+// NewDecoder returns a new decoder that reads from r.
+//
+// If r does not implement io.ByteScanner, the decoder buffers it and may read
+// past the values it decodes; Buffered returns that excess data.
+func NewDecoder(r io.Reader) *Decoder {
+	return DecoderOptions{}.NewDecoder(r)
+}
+
+// NewDecoder returns a new decoder that reads from r and applies opts to
+// every value it decodes.
+func (opts DecoderOptions) NewDecoder(r io.Reader) *Decoder {
+	if br, ok := r.(byteReader); ok {
+		return &Decoder{r: br, opts: opts}
+	}
+
+	buf := bufio.NewReader(r)
+	return &Decoder{r: buf, buf: buf, opts: opts}
+}
+
+// Decode reads the next bencoded value from its input and stores it in the
+// value pointed to by v, following the rules of Unmarshal. At the end of the
+// input Decode returns io.EOF. After any other error the position of the
+// decoder in the stream is undefined.
+func (dec *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	if _, err := dec.r.ReadByte(); err != nil {
+		return err
+	}
+	dec.r.UnreadByte()
+
+	n, err := unmarshal(dec.r, v, dec.opts)
+	switch e := err.(type) {
+	case *SyntaxError:
+		e.Offset += dec.off
+	case *LimitError:
+		e.Offset += dec.off
+	case *UnmarshalTypeError:
+		e.Offset += dec.off
+	}
+	dec.off += n
+
+	return err
+}
+
+// Strict makes the decoder reject non-canonical input the way
+// UnmarshalStrict does. Data following a value is left for the next Decode.
+func (dec *Decoder) Strict() {
+	dec.opts.Strict = true
+}
+
+// InputOffset returns the number of bytes consumed by the decoded values so
+// far. Data held in the decoder's buffer is not counted.
+func (dec *Decoder) InputOffset() int64 {
+	return dec.off
+}
+
+// Buffered returns a reader of the data remaining in the decoder's buffer.
+// The reader is valid until the next call to Decode.
+func (dec *Decoder) Buffered() io.Reader {
+	if dec.buf == nil {
+		return bytes.NewReader(nil)
+	}
+
+	data, _ := dec.buf.Peek(dec.buf.Buffered())
+	return bytes.NewReader(data)
+}
@@ -1,118 +1,815 @@
 package bencode
 
 import (
-	"errors"
+	"bytes"
+	"io"
+	"reflect"
 	"strconv"
+	"strings"
 )
 
-func readUntil(data []byte, symbol byte) ([]byte, int, bool) {
-	for i, b := range data {
-		if b == symbol {
-			return data[:i], i, true
+// An UnmarshalTypeError describes a bencode value that was not appropriate
+// for a value of a specific Go type.
+type UnmarshalTypeError struct {
+	Value  string       // description of the bencode value, e.g. "integer 300"
+	Type   reflect.Type // type of the Go value it could not be assigned to
+	Offset int64        // offset of the bencode value in the input
+	Path   string       // path of the value from the root, e.g. "r.nodes[3]"
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Path == "" {
+		return "bencode: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+	}
+	return "bencode: cannot unmarshal " + e.Value + " into Go value " + e.Path + " of type " + e.Type.String()
+}
+
+// An InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+// (The argument to Unmarshal must be a non-nil pointer.)
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Ptr {
+		return "bencode: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "bencode: Unmarshal(nil " + e.Type.String() + ")"
+}
+
+// A SyntaxError describes malformed bencode.
+type SyntaxError struct {
+	msg    string
+	Offset int64 // the error occurred after reading Offset bytes
+}
+
+func (e *SyntaxError) Error() string {
+	return "bencode: " + e.msg + " at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+// A LimitError reports input that exceeds one of the DecoderOptions limits.
+type LimitError struct {
+	Limit  string // name of the DecoderOptions field that was exceeded
+	Offset int64  // the limit was hit after reading Offset bytes
+}
+
+func (e *LimitError) Error() string {
+	return "bencode: input exceeds " + e.Limit + " at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+// DecoderOptions controls how strictly input is checked and bounds the
+// resources one decoded value may use, so that hostile input is rejected with
+// an error rather than exhausting memory or the stack. Zero limits mean no
+// limit, except that nesting is never allowed deeper than maxDepth.
+type DecoderOptions struct {
+	// Strict rejects non-canonical input, see UnmarshalStrict.
+	Strict bool
+
+	// MaxDepth limits how deeply lists and dictionaries may nest.
+	MaxDepth int
+
+	// MaxStringLength limits the length of a single string.
+	MaxStringLength int64
+
+	// MaxItems limits the total number of values, counting every list
+	// element and dictionary entry.
+	MaxItems int
+
+	// MaxSize limits the number of bytes a value may span.
+	MaxSize int64
+}
+
+// maxDepth is the nesting limit that applies when MaxDepth is not set.
+const maxDepth = 10000
+
+// maxIntegerLength bounds the digits of an integer or string length, which
+// is far more than any value that fits in 64 bits needs.
+const maxIntegerLength = 64
+
+// Unmarshal parses the bencoded data and stores the result in the value
+// pointed to by v, which must be a non-nil pointer.
+//
+// Into an empty interface Unmarshal stores int64 for integers, []byte for
+// strings, []interface{} for lists and map[string]interface{} for
+// dictionaries. Otherwise it follows the rules of Marshal in reverse:
+// dictionary keys are matched against struct field names or tags, unknown
+// keys are ignored, and a string decodes into a byte array only if the
+// lengths match exactly.
+//
+// Types implementing Unmarshaler, such as RawMessage, receive the exact bytes
+// of their value instead.
+//
+// If a value does not fit the Go type it is decoded into, Unmarshal skips it,
+// completes the rest of the decoding and returns an *UnmarshalTypeError for
+// the first such value. Malformed input yields a *SyntaxError. Data after
+// the first complete value is ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	return DecoderOptions{}.Unmarshal(data, v)
+}
+
+// UnmarshalStrict is like Unmarshal but only accepts canonical bencode, the
+// only form whose hash can be trusted: dictionary keys must be unique and
+// sorted in raw byte order, integers and string lengths must not have
+// leading zeros, "i-0e" is invalid, and data must hold exactly one value.
+func UnmarshalStrict(data []byte, v interface{}) error {
+	return DecoderOptions{Strict: true}.Unmarshal(data, v)
+}
+
+// Unmarshal is like the package-level Unmarshal but applies opts. A
+// violated limit yields a *LimitError. In strict mode trailing data after the
+// value is an error.
+func (opts DecoderOptions) Unmarshal(data []byte, v interface{}) error {
+	r := bytes.NewReader(data)
+	n, err := unmarshal(r, v, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Strict && r.Len() > 0 {
+		return &SyntaxError{"trailing data after top-level value", n}
+	}
+
+	return nil
+}
+
+// unmarshal decodes one value from r into v and returns the number of bytes
+// it consumed.
+func unmarshal(r byteReader, v interface{}, opts DecoderOptions) (int64, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return 0, &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	d := &decodeState{r: r, opts: opts}
+	if d.opts.MaxDepth <= 0 || d.opts.MaxDepth > maxDepth {
+		d.opts.MaxDepth = maxDepth
+	}
+
+	if err := d.value(rv); err != nil {
+		return d.off, err
+	}
+
+	return d.off, d.savedError
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+type decodeState struct {
+	r    byteReader
+	off  int64
+	opts DecoderOptions
+
+	depth int
+	items int
+
+	// record collects the bytes consumed while capturing a raw value.
+	record *bytes.Buffer
+
+	path       []string
+	savedError error
+}
+
+// smallString is the largest string that is read in one allocation. Longer
+// strings are read in chunks, so a forged length prefix cannot make the
+// decoder allocate more memory than the input actually holds.
+const smallString = 4096
+
+func (d *decodeState) syntaxError(msg string) error {
+	return &SyntaxError{msg, d.off}
+}
+
+func (d *decodeState) limitError(limit string) error {
+	return &LimitError{limit, d.off}
+}
+
+// readError reports the end of the input in the middle of a value as a
+// syntax error.
+func (d *decodeState) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.syntaxError("unexpected end of input")
+	}
+
+	return err
+}
+
+// reserve checks that n more bytes may be read under MaxSize.
+func (d *decodeState) reserve(n int64) error {
+	if d.opts.MaxSize > 0 && n > d.opts.MaxSize-d.off {
+		return d.limitError("MaxSize")
+	}
+
+	return nil
+}
+
+func (d *decodeState) peek() (byte, error) {
+	if err := d.reserve(1); err != nil {
+		return 0, err
+	}
+
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.readError(err)
+	}
+
+	return c, d.r.UnreadByte()
+}
+
+func (d *decodeState) readByte() (byte, error) {
+	if err := d.reserve(1); err != nil {
+		return 0, err
+	}
+
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.readError(err)
+	}
+
+	d.off++
+	if d.record != nil {
+		d.record.WriteByte(c)
+	}
+	return c, nil
+}
+
+// skipByte consumes the byte returned by the last peek.
+func (d *decodeState) skipByte() {
+	c, _ := d.r.ReadByte()
+	d.off++
+	if d.record != nil {
+		d.record.WriteByte(c)
+	}
+}
+
+// readDigits reads the digits of an integer or a string length up to the
+// terminating symbol.
+func (d *decodeState) readDigits(symbol byte) ([]byte, error) {
+	var buf []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if c == symbol {
+			if !validInteger(buf) {
+				return nil, d.syntaxError("invalid integer " + strconv.Quote(string(buf)))
+			}
+
+			if d.opts.Strict && !canonicalInteger(buf) {
+				return nil, d.syntaxError("non-canonical integer " + string(buf))
+			}
+
+			return buf, nil
+		}
+
+		if len(buf) == maxIntegerLength {
+			return nil, d.syntaxError("integer too long")
 		}
+
+		buf = append(buf, c)
+	}
+}
+
+func (d *decodeState) readFull(n int64) ([]byte, error) {
+	if err := d.reserve(n); err != nil {
+		return nil, err
 	}
 
-	return nil, 0, false
+	if n <= smallString {
+		buf := make([]byte, n)
+		m, err := io.ReadFull(d.r, buf)
+		d.off += int64(m)
+		if err != nil {
+			return nil, d.readError(err)
+		}
+
+		if d.record != nil {
+			d.record.Write(buf)
+		}
+		return buf, nil
+	}
+
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, d.r, n)
+	d.off += m
+	if err != nil {
+		return nil, d.readError(err)
+	}
+
+	if d.record != nil {
+		d.record.Write(buf.Bytes())
+	}
+	return buf.Bytes(), nil
 }
 
-func Unmarshal(data []byte) (interface{}, error) {
-	result, _, err := unmarshal(data)
+// readInteger consumes an integer field and returns its digits.
+func (d *decodeState) readInteger() ([]byte, error) {
+	d.skipByte()
+
+	return d.readDigits('e')
+}
+
+// readString consumes a string field and returns its contents.
+func (d *decodeState) readString() ([]byte, error) {
+	stringLengthBuffer, err := d.readDigits(':')
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	stringLength, err := strconv.ParseInt(string(stringLengthBuffer), 10, 64)
+	if err != nil || stringLength < 0 {
+		return nil, d.syntaxError("invalid string length " + string(stringLengthBuffer))
+	}
+
+	if d.opts.MaxStringLength > 0 && stringLength > d.opts.MaxStringLength {
+		return nil, d.limitError("MaxStringLength")
+	}
+
+	return d.readFull(stringLength)
 }
 
-func unmarshal(data []byte) (interface{}, int, error) {
-	switch data[0] {
-	case 'i':
-		integerBuffer, length, ok := readUntil(data[1:], 'e')
-		if !ok {
-			return nil, 0, errors.New("bencode: invalid integer field")
+func validInteger(buf []byte) bool {
+	if len(buf) > 0 && buf[0] == '-' {
+		buf = buf[1:]
+	}
+	if len(buf) == 0 {
+		return false
+	}
+	for _, c := range buf {
+		if c < '0' || c > '9' {
+			return false
 		}
+	}
 
-		integer, err := strconv.ParseInt(string(integerBuffer), 10, 64)
+	return true
+}
+
+// canonicalInteger reports whether the valid integer buf has no leading
+// zeros and is not negative zero.
+func canonicalInteger(buf []byte) bool {
+	if buf[0] == '-' {
+		return buf[1] != '0'
+	}
+
+	return buf[0] != '0' || len(buf) == 1
+}
+
+// checkKeyOrder enforces strictly increasing dictionary keys in strict mode.
+func (d *decodeState) checkKeyOrder(prev, key []byte, first bool) error {
+	if !d.opts.Strict || first {
+		return nil
+	}
+
+	switch c := bytes.Compare(prev, key); {
+	case c == 0:
+		return d.syntaxError("duplicate dictionary key " + strconv.Quote(string(key)))
+	case c > 0:
+		return d.syntaxError("unsorted dictionary key " + strconv.Quote(string(key)))
+	}
+
+	return nil
+}
+
+// next peeks at the start of the next value and counts it against MaxItems.
+func (d *decodeState) next() (byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+
+	d.items++
+	if d.opts.MaxItems > 0 && d.items > d.opts.MaxItems {
+		return 0, d.limitError("MaxItems")
+	}
+
+	switch {
+	case c == 'i', c == 'l', c == 'd', c >= '0' && c <= '9':
+		return c, nil
+	default:
+		return 0, d.syntaxError("invalid character " + strconv.QuoteRune(rune(c)) + " looking for beginning of value")
+	}
+}
+
+// enter consumes the opening byte of a list or dictionary.
+func (d *decodeState) enter() error {
+	d.depth++
+	if d.depth > d.opts.MaxDepth {
+		return d.limitError("MaxDepth")
+	}
+
+	d.skipByte()
+	return nil
+}
+
+// more reports whether the list or dictionary being decoded has another
+// element, and consumes its closing byte if not.
+func (d *decodeState) more() (bool, error) {
+	c, err := d.peek()
+	if err != nil {
+		return false, err
+	}
+
+	if c == 'e' {
+		d.skipByte()
+		d.depth--
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// key reads a dictionary key.
+func (d *decodeState) key(prev []byte, first bool) ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if c < '0' || c > '9' {
+		return nil, d.syntaxError("non-string dictionary key")
+	}
+
+	key, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.checkKeyOrder(prev, key, first); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (d *decodeState) pushPath(elem string) {
+	d.path = append(d.path, elem)
+}
+
+func (d *decodeState) popPath() {
+	d.path = d.path[:len(d.path)-1]
+}
+
+func (d *decodeState) pathString() string {
+	var b strings.Builder
+	for _, elem := range d.path {
+		if b.Len() > 0 && !strings.HasPrefix(elem, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(elem)
+	}
+
+	return b.String()
+}
+
+// saveTypeError records the first type mismatch so that decoding can go on.
+func (d *decodeState) saveTypeError(what string, t reflect.Type, offset int64) {
+	if d.savedError == nil {
+		d.savedError = &UnmarshalTypeError{
+			Value:  what,
+			Type:   t,
+			Offset: offset,
+			Path:   d.pathString(),
+		}
+	}
+}
+
+// indirect walks down v allocating pointers as needed.
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	return v
+}
+
+// value decodes the next value into v. An invalid v discards the value.
+func (d *decodeState) value(v reflect.Value) error {
+	if !v.IsValid() {
+		_, err := d.valueInterface()
+		return err
+	}
+
+	v = indirect(v)
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(unmarshalerType) {
+		raw, err := d.rawValue()
 		if err != nil {
-			return nil, 0, err
+			return err
+		}
+
+		if err := v.Addr().Interface().(Unmarshaler).UnmarshalBencode(raw); err != nil && d.savedError == nil {
+			d.savedError = err
 		}
+		return nil
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.valueInterface()
+		if err != nil {
+			return err
+		}
+
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
 
-		return integer, length + 2, nil
+	c, err := d.next()
+	if err != nil {
+		return err
+	}
 
+	switch c {
+	case 'i':
+		return d.integer(v)
 	case 'l':
-		list := []interface{}{}
-		totalLength := 2
-		data = data[1:]
-		for {
-			if len(data) == 0 {
-				return nil, 0, errors.New("bencode: invalid list field")
-			}
+		return d.list(v)
+	case 'd':
+		return d.dictionary(v)
+	default:
+		return d.str(v)
+	}
+}
 
-			if data[0] == 'e' {
-				return list, totalLength, nil
-			}
+func (d *decodeState) integer(v reflect.Value) error {
+	start := d.off
+	integerBuffer, err := d.readInteger()
+	if err != nil {
+		return err
+	}
 
-			value, length, err := unmarshal(data)
-			if err != nil {
-				return nil, 0, err
-			}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer, err := strconv.ParseInt(string(integerBuffer), 10, 64)
+		if err != nil || v.OverflowInt(integer) {
+			d.saveTypeError("integer "+string(integerBuffer), v.Type(), start)
+			break
+		}
+		v.SetInt(integer)
 
-			list = append(list, value)
-			data = data[length:]
-			totalLength += length
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		integer, err := strconv.ParseUint(string(integerBuffer), 10, 64)
+		if err != nil || v.OverflowUint(integer) {
+			d.saveTypeError("integer "+string(integerBuffer), v.Type(), start)
+			break
 		}
+		v.SetUint(integer)
 
-	case 'd':
-		dictionary := map[string]interface{}{}
-		totalLength := 2
-		data = data[1:]
-		for {
-			if len(data) == 0 {
-				return nil, 0, errors.New("bencode: invalid dictionary field")
-			}
+	case reflect.Bool:
+		v.SetBool(string(integerBuffer) != "0")
 
-			if data[0] == 'e' {
-				return dictionary, totalLength, nil
-			}
+	default:
+		d.saveTypeError("integer", v.Type(), start)
+	}
 
-			value, length, err := unmarshal(data)
-			if err != nil {
-				return nil, 0, err
-			}
+	return nil
+}
 
-			key, ok := value.([]byte)
-			if !ok {
-				return nil, 0, errors.New("bencode: non-string dictionary key")
-			}
+func (d *decodeState) str(v reflect.Value) error {
+	start := d.off
+	buf, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(buf))
 
-			data = data[length:]
-			totalLength += length
-			value, length, err = unmarshal(data)
-			if err != nil {
-				return nil, 0, err
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			d.saveTypeError("string", v.Type(), start)
+			break
+		}
+		v.SetBytes(buf)
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			d.saveTypeError("string", v.Type(), start)
+			break
+		}
+		if len(buf) != v.Len() {
+			d.saveTypeError("string of length "+strconv.Itoa(len(buf)), v.Type(), start)
+			break
+		}
+		for i, b := range buf {
+			v.Index(i).SetUint(uint64(b))
+		}
+
+	default:
+		d.saveTypeError("string", v.Type(), start)
+	}
+
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value) error {
+	start := d.off
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		d.saveTypeError("list", v.Type(), start)
+		_, err := d.listInterface()
+		return err
+	}
+
+	var slice reflect.Value
+	if v.Kind() == reflect.Slice {
+		slice = reflect.MakeSlice(v.Type(), 0, 0)
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		more, err := d.more()
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+
+		var elem reflect.Value
+		if v.Kind() == reflect.Slice {
+			elem = reflect.New(v.Type().Elem()).Elem()
+		} else if i < v.Len() {
+			elem = v.Index(i)
+		}
+
+		d.pushPath("[" + strconv.Itoa(i) + "]")
+		err = d.value(elem)
+		d.popPath()
+		if err != nil {
+			return err
+		}
+
+		if v.Kind() == reflect.Slice {
+			slice = reflect.Append(slice, elem)
+		} else if i >= v.Len() {
+			d.saveTypeError("list of more than "+strconv.Itoa(v.Len())+" elements", v.Type(), start)
+		}
+	}
+
+	if v.Kind() == reflect.Slice {
+		v.Set(slice)
+	}
+
+	return nil
+}
+
+func (d *decodeState) dictionary(v reflect.Value) error {
+	start := d.off
+	var fields []field
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			d.saveTypeError("dictionary", v.Type(), start)
+			_, err := d.dictionaryInterface()
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+	case reflect.Struct:
+		fields = cachedFields(v.Type())
+
+	default:
+		d.saveTypeError("dictionary", v.Type(), start)
+		_, err := d.dictionaryInterface()
+		return err
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+
+	var prev []byte
+	for first := true; ; first = false {
+		more, err := d.more()
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+
+		key, err := d.key(prev, first)
+		if err != nil {
+			return err
+		}
+		prev = key
+
+		d.pushPath(string(key))
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem)
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+		} else {
+			var elem reflect.Value
+			if f := lookupField(fields, string(key)); f != nil {
+				elem = v.FieldByIndex(f.index)
 			}
+			err = d.value(elem)
+		}
+		d.popPath()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// valueInterface decodes the next value into its generic representation.
+func (d *decodeState) valueInterface() (interface{}, error) {
+	c, err := d.next()
+	if err != nil {
+		return nil, err
+	}
 
-			dictionary[string(key)] = value
-			data = data[length:]
-			totalLength += length
+	switch c {
+	case 'i':
+		start := d.off
+		integerBuffer, err := d.readInteger()
+		if err != nil {
+			return nil, err
 		}
 
+		integer, err := strconv.ParseInt(string(integerBuffer), 10, 64)
+		if err != nil {
+			d.saveTypeError("integer "+string(integerBuffer), reflect.TypeOf(integer), start)
+		}
+
+		return integer, nil
+
+	case 'l':
+		return d.listInterface()
+
+	case 'd':
+		return d.dictionaryInterface()
+
 	default:
-		stringLengthBuffer, length, ok := readUntil(data, ':')
-		if !ok {
-			return nil, 0, errors.New("bencode: invalid string field")
+		return d.readString()
+	}
+}
+
+func (d *decodeState) listInterface() ([]interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+
+	list := []interface{}{}
+	for {
+		more, err := d.more()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return list, nil
 		}
 
-		stringLength, err := strconv.ParseInt(string(stringLengthBuffer), 10, 64)
+		value, err := d.valueInterface()
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
-		endPosition := length + 1 + int(stringLength)
-		if endPosition > len(data) {
-			return nil, 0, errors.New("bencode: not a valid bencoded string")
+		list = append(list, value)
+	}
+}
+
+func (d *decodeState) dictionaryInterface() (map[string]interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+
+	dictionary := map[string]interface{}{}
+	var prev []byte
+	for first := true; ; first = false {
+		more, err := d.more()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return dictionary, nil
+		}
+
+		key, err := d.key(prev, first)
+		if err != nil {
+			return nil, err
+		}
+		prev = key
+
+		value, err := d.valueInterface()
+		if err != nil {
+			return nil, err
 		}
 
-		return data[length+1 : endPosition], endPosition, nil
+		dictionary[string(key)] = value
 	}
 }
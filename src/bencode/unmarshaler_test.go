@@ -0,0 +1,166 @@
+package bencode
+
+import (
+	"reflect"
+	"testing"
+)
+
+type response struct {
+	ID     [4]byte  `bencode:"id"`
+	Nodes  []byte   `bencode:"nodes"`
+	Values []string `bencode:"values"`
+	Port   uint16   `bencode:"port"`
+}
+
+type message struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	R *response  `bencode:"r"`
+	A RawMessage `bencode:"a"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	answer := int64(42)
+	for _, c := range []struct {
+		data string
+		want interface{} // a pointer to the expected value
+	}{
+		{"i42e", &answer},
+		{"i-7e", func() *int8 { v := int8(-7); return &v }()},
+		{"i1e", func() *bool { v := true; return &v }()},
+		{"4:spam", func() *string { v := "spam"; return &v }()},
+		{"4:spam", &[]byte{'s', 'p', 'a', 'm'}},
+		{"4:spam", &[4]byte{'s', 'p', 'a', 'm'}},
+		{"l1:a1:be", &[]string{"a", "b"}},
+		{"li1ei2ee", &[2]int{1, 2}},
+		{"d1:ai1e1:bi2ee", &map[string]int{"a": 1, "b": 2}},
+		{
+			"li1e1:ald1:ki2eeee",
+			func() *interface{} {
+				var v interface{} = []interface{}{int64(1), []byte("a"),
+					[]interface{}{map[string]interface{}{"k": int64(2)}}}
+				return &v
+			}(),
+		},
+		{
+			// unknown keys are skipped, "a" is kept as it came
+			"d1:ad2:idi1ee1:rd2:id4:abcd5:nodes2:xy4:porti6881e6:valuesl1:pee1:t2:aa1:x3:foo1:y1:re",
+			&message{T: "aa", Y: "r", A: RawMessage("d2:idi1ee"),
+				R: &response{ID: [4]byte{'a', 'b', 'c', 'd'}, Nodes: []byte("xy"), Values: []string{"p"}, Port: 6881}},
+		},
+		{"d1:ai1e1:ci2e8:shadowed5:showne", &outer{inner{1, ""}, "shown", 2}},
+		{"d1:Ci3e1:xi1ee", &duplicate{C: 3}},
+		{"d4:Namei3e1:li2e1:ri5e6:sharedi7ee", &twoEmbeds{left{L: 2, Name: 3}, right{R: 5}}},
+		{"d8:Untaggedi1e9:info_hash4:abcde", &tagged{InfoHash: [4]byte{'a', 'b', 'c', 'd'}, Untagged: true}},
+		// trailing data is ignored outside strict mode
+		{"i1ei2e", func() *int { v := 1; return &v }()},
+	} {
+		got := reflect.New(reflect.TypeOf(c.want).Elem())
+		if err := Unmarshal([]byte(c.data), got.Interface()); err != nil {
+			t.Errorf("%q: %v", c.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Interface(), c.want) {
+			t.Errorf("%q: got %#v, want %#v", c.data, got.Elem().Interface(), reflect.ValueOf(c.want).Elem().Interface())
+		}
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	for _, c := range []struct {
+		data  string
+		v     interface{}
+		value string
+		path  string
+		off   int64
+	}{
+		{"i300e", new(int8), "integer 300", "", 0},
+		{"i-1e", new(uint), "integer -1", "", 0},
+		{"3:abc", new(int), "string", "", 0},
+		{"3:abc", new([4]byte), "string of length 3", "", 0},
+		{"li1ee", new(string), "list", "", 0},
+		{"li1ei2ei3ee", new([2]int), "list of more than 2 elements", "", 0},
+		{"d1:ai1ee", new([]int), "dictionary", "", 0},
+		{"d1:rd2:id3:abcee", new(message), "string of length 3", "r.id", 9},
+		{"d1:rd6:valuesl1:ai2eeee", new(message), "integer", "r.values[1]", 17},
+		{"ld1:rd4:porti70000eeee", new([]message), "integer 70000", "[0].r.port", 12},
+	} {
+		err := Unmarshal([]byte(c.data), c.v)
+		e, ok := err.(*UnmarshalTypeError)
+		if !ok {
+			t.Errorf("%q: got %v, want an UnmarshalTypeError", c.data, err)
+			continue
+		}
+		if e.Value != c.value || e.Path != c.path || e.Offset != c.off {
+			t.Errorf("%q: got value %q path %q offset %d, want %q %q %d",
+				c.data, e.Value, e.Path, e.Offset, c.value, c.path, c.off)
+		}
+		if e.Type != reflect.TypeOf(c.v).Elem() && e.Path == "" {
+			t.Errorf("%q: type %v, want %v", c.data, e.Type, reflect.TypeOf(c.v).Elem())
+		}
+	}
+
+	// Decoding goes on after a type error.
+	var m message
+	err := Unmarshal([]byte("d1:rd2:id1:x4:porti1ee1:t2:aae"), &m)
+	if _, ok := err.(*UnmarshalTypeError); !ok || m.T != "aa" || m.R == nil || m.R.Port != 1 {
+		t.Errorf("got %+v and %v", m, err)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for _, data := range []string{"", "i1", "ie", "i1.5e", "5:abc", "l", "d1:ae", "di1ei2ee", "x"} {
+		var v interface{}
+		if _, ok := Unmarshal([]byte(data), &v).(*SyntaxError); !ok {
+			t.Errorf("%q: no syntax error", data)
+		}
+	}
+
+	var v int
+	if _, ok := Unmarshal([]byte("i1e"), v).(*InvalidUnmarshalError); !ok {
+		t.Error("non-pointer accepted")
+	}
+	if _, ok := Unmarshal([]byte("i1e"), nil).(*InvalidUnmarshalError); !ok {
+		t.Error("nil accepted")
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	for _, data := range []string{
+		"d1:bi1e1:ai2ee", // unsorted keys
+		"d1:ai1e1:ai2ee", // duplicate keys
+		"i03e",
+		"i-0e",
+		"03:abc",
+		"i1ei2e", // trailing data
+	} {
+		var v interface{}
+		if _, ok := UnmarshalStrict([]byte(data), &v).(*SyntaxError); !ok {
+			t.Errorf("%q accepted in strict mode", data)
+		}
+	}
+
+	var v interface{}
+	if err := UnmarshalStrict([]byte("d1:ai1e1:bli2eee"), &v); err != nil {
+		t.Errorf("canonical input rejected: %v", err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	for _, c := range []struct {
+		opts  DecoderOptions
+		data  string
+		limit string
+	}{
+		{DecoderOptions{MaxDepth: 2}, "llleee", "MaxDepth"},
+		{DecoderOptions{MaxStringLength: 3}, "4:spam", "MaxStringLength"},
+		{DecoderOptions{MaxItems: 2}, "li1ei2ei3ee", "MaxItems"},
+		{DecoderOptions{MaxSize: 4}, "4:spam", "MaxSize"},
+	} {
+		var v interface{}
+		err := c.opts.Unmarshal([]byte(c.data), &v)
+		if e, ok := err.(*LimitError); !ok || e.Limit != c.limit {
+			t.Errorf("%q: got %v, want a %s LimitError", c.data, err, c.limit)
+		}
+	}
+}
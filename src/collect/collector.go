@@ -1,44 +1,108 @@
 package collect
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"sync"
+)
 
 const maxpendendingN = 5000
 
+var (
+	TooManyQueriesError = errors.New("too many queries")
+	ClosedError = errors.New("collector is shut down")
+)
+
 type Collector struct {
 	closeEvent 			chan struct{}
 	queryEvent			chan *metadataQuery
 	HandleQueryEvent 	chan struct{}
+
+	ctx					context.Context		// canceled to abort running queries
+	cancel				context.CancelFunc
+	queries				sync.WaitGroup
+	workDone			chan struct{}
+	closeOnce			sync.Once
+	done				chan struct{}
 }
 
 
 func NewCollector() *Collector{
-	ret := &Collector{
-		make(chan struct{}),
-		make(chan *metadataQuery),
-		make(chan struct{}),
+	ctx,cancel := context.WithCancel(context.Background())
+	workDone := make(chan struct{})
+	close(workDone)
+	return &Collector{
+		closeEvent:			make(chan struct{}),
+		queryEvent:			make(chan *metadataQuery),
+		HandleQueryEvent:	make(chan struct{}),
+		ctx:				ctx,
+		cancel:				cancel,
+		workDone:			workDone,
+		done:				make(chan struct{}),
 	}
+}
 
-	go ret.work()
+// Start starts accepting queries. Canceling ctx aborts the running queries
+// and shuts the collector down.
+func (this *Collector) Start(ctx context.Context) error{
+	this.cancel()
+	this.ctx,this.cancel = context.WithCancel(ctx)
+	this.workDone = make(chan struct{})
+	go this.work()
+	go func() {
+		<-this.ctx.Done()
+		_ = this.Shutdown(context.Background())
+	}()
+	return nil
+}
 
-	return ret
+// Shutdown stops accepting queries and waits for the running ones to
+// finish. If ctx ends first they are aborted and ctx.Err() is returned.
+func (this *Collector) Shutdown(ctx context.Context) error{
+	this.closeOnce.Do(func() {
+		close(this.closeEvent)
+		go func() {
+			<-this.workDone
+			this.queries.Wait()
+			this.cancel()
+			close(this.done)
+		}()
+	})
+
+	select {
+	case <-this.done:
+		return nil
+	case <-ctx.Done():
+		this.cancel()
+		<-this.done
+		return ctx.Err()
+	}
 }
 
+// Done is closed once the collector has shut down.
+func (this *Collector) Done() <-chan struct{}{
+	return this.done
+}
 
 func (this *Collector) work(){
+	defer close(this.workDone)
 	pending := 0
-	
+
 	for{
 		if pending >= maxpendendingN{
 			select {
 			case <- this.closeEvent:
+				return
 			case <- this.HandleQueryEvent:
 				pending--
 			}
 		}else{
 			select {
 			case <- this.closeEvent:
+				return
 			case query := <- this.queryEvent:
 				pending++
+				this.queries.Add(1)
 				go query.work(this)
 			case <- this.HandleQueryEvent:
 				pending--
@@ -47,20 +111,22 @@ func (this *Collector) work(){
 	}
 }
 
-func (this *Collector)Stop(){
-	close(this.closeEvent)
-	close(this.HandleQueryEvent)
-	close(this.queryEvent)
-}
-
 func (this *Collector) Get(request *Request)  error{
 	query := newMetadataQuery(request)
 
+	select {
+	case <-this.closeEvent:
+		return ClosedError
+	default:
+	}
+
 	select {
 	case this.queryEvent <- query:
+	case <-this.closeEvent:
+		return ClosedError
 	default:
-		return errors.New("too many queries")
+		return TooManyQueriesError
 	}
 
 	return nil
-}
\ No newline at end of file
+}
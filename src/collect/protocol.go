@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"time"
 )
@@ -45,35 +46,53 @@ func readPacket(conn net.Conn,buf *bytes.Buffer,size int64) error{
 	return nil
 }
 
-func readMessage(conn net.Conn,buf *bytes.Buffer)(int,int,error){
+const (
+	keepAlive  = -1
+	extendedID = 20
+)
+
+// readMessage reads the header of the next peer message. It returns the
+// message ID (keepAlive for keep-alives), the extended message ID for BEP 10
+// messages and a reader over the rest of the payload, which has to be
+// drained before the next message can be read.
+func readMessage(conn net.Conn,buf *bytes.Buffer)(int,int,*io.LimitedReader,error){
+	buf.Reset()
 	err := readPacket(conn,buf,4)
 	if err != nil{
-		return 0,0,err
+		return 0,0,nil,err
 	}
 	l := int64(binary.BigEndian.Uint32(buf.Next(4)))
 
 	if l == 0{
-		return 0,0,errors.New("read message error")
+		return keepAlive,0,&io.LimitedReader{R: conn},nil
 	}
 
-	err = readPacket(conn,buf,l)
-	if err != nil{
-		return 0,0,err
-	}
-	temp,err := buf.ReadByte()
+	err = readPacket(conn,buf,1)
 	if err != nil{
-		return 0,0,err
+		return 0,0,nil,err
 	}
+	temp,_ := buf.ReadByte()
 	st := int(temp)
-
-	temp,err = buf.ReadByte()
-	if err != nil{
-		return 0,0,err
+	l--
+
+	ed := 0
+	if st == extendedID && l > 0{
+		err = readPacket(conn,buf,1)
+		if err != nil{
+			return 0,0,nil,err
+		}
+		temp,_ = buf.ReadByte()
+		ed = int(temp)
+		l--
 	}
 
-	ed := int(temp)
+	conn.SetReadDeadline(time.Now().Add(readTimeLimit))
+	return st,ed,&io.LimitedReader{R: conn, N: l},nil
+}
 
-	return st,ed,nil
+func skipMessage(payload io.Reader) error{
+	_,err := io.Copy(ioutil.Discard,payload)
+	return err
 }
 
 
@@ -109,6 +128,19 @@ const (
 	rejectType  = 2
 )
 
+// peerMessageOptions bounds the dictionaries we decode from peer messages.
+var peerMessageOptions = bencode.DecoderOptions{
+	MaxDepth:			8,
+	MaxStringLength:	4096,
+	MaxItems:			1024,
+}
+
+// metadataMessage is the dictionary heading every ut_metadata message.
+type metadataMessage struct {
+	MsgType   int   `bencode:"msg_type"`
+	Piece     int   `bencode:"piece"`
+	TotalSize int64 `bencode:"total_size,omitempty"`
+}
 
 func writePacket2(conn net.Conn, data []byte, begin,end int) error {
 	length := len(data) + 2
@@ -122,66 +154,83 @@ func writePacket2(conn net.Conn, data []byte, begin,end int) error {
 }
 
 func sendRequest(conn net.Conn,metaInfo int, pieceID int) error{
-	msg,_ := bencode.Marshal(map[string]interface{}{
-		"msg_type":  requestType,
-		"piece":		pieceID,
+	msg,_ := bencode.Marshal(&metadataMessage{
+		MsgType:	requestType,
+		Piece:		pieceID,
 	})
 	return writePacket2(conn,msg,20,metaInfo)
 }
 
-func extractPieceInfo(data []byte) (Type,pieceID,size,offset int,err error) {
-	temp,err := bencode.Unmarshal(data)
-	if err != nil{
+// readPiece decodes the ut_metadata message in payload and returns its type,
+// the piece index and the piece data that follows the dictionary.
+func readPiece(payload *io.LimitedReader) (Type,pieceID int,piece []byte,err error) {
+	size := payload.N
+	dec := peerMessageOptions.NewDecoder(payload)
+
+	var msg metadataMessage
+	if err = dec.Decode(&msg); err != nil{
 		return
 	}
-	Map := temp.(map[string]interface{})
-	Type = int(Map["msg_type"].(int64))
-	pieceID = int(Map["piece"].(int64))
+	Type = msg.MsgType
+	pieceID = msg.Piece
 
-	bcode,_ := bencode.Marshal(temp)
-	offset = len(bcode)
+	size -= dec.InputOffset()
+	if size > BLOCKSIZE{
+		err = errors.New("piece too large")
+		return
+	}
+	piece = make([]byte,size)
+	_,err = io.ReadFull(io.MultiReader(dec.Buffered(),payload),piece)
 	return
 }
 
 
 /*From bep10*/
+
+// extendedHandshake is the payload of the BEP 10 extension handshake.
+type extendedHandshake struct {
+	M            map[string]int64 `bencode:"m"`
+	MetadataSize int64            `bencode:"metadata_size,omitempty"`
+}
+
 func sendHandshakeExtended(conn net.Conn,query *metadataQuery) error  {
-	Map := map[string]interface{}{
-		"m": map[string]interface{}{
+	msg,_ := bencode.Marshal(&extendedHandshake{
+		M: map[string]int64{
 			"ut_metadata": 0,
 		},
-	}
-
-	msg,_ := bencode.Marshal(Map)
+	})
 
 	return writePacket2(conn,msg,20,0)
 }
 
 
 func receiveHandshakeExtended(conn net.Conn,buffer *bytes.Buffer)(int64,int64,error){
-	_,_,err := readMessage(conn,buffer)
-	if buffer.Len() == 0{
-		err = errors.New("read error")
+	for{
+		id,ext,payload,err := readMessage(conn,buffer)
+		if err != nil{
+			return 0,0,err
+		}
+		if id != extendedID || ext != 0{
+			if err := skipMessage(payload); err != nil{
+				return 0,0,err
+			}
+			continue
+		}
+
+		var msg extendedHandshake
+		if err := peerMessageOptions.NewDecoder(payload).Decode(&msg); err != nil{
+			return 0,0,err
+		}
+
+		if msg.MetadataSize <= 0{
+			return 0,0,errors.New("no metadata_size")
+		}
+
+		utMetadata,ok := msg.M["ut_metadata"]
+		if !ok{
+			return 0,0,errors.New("no ut_metadata")
+		}
+
+		return utMetadata,msg.MetadataSize,nil
 	}
-	if err != nil{
-		return 0,0,err
-	}
-
-	temp,err := bencode.Unmarshal(buffer.Bytes())
-
-	if err != nil{
-		return 0,0,err
-	}
-
-	Map := temp.(map[string]interface{})
-	size,ok := Map["metadata_size"]
-
-	if !ok{
-		err = errors.New("no metadata_size")
-		return 0,0,err
-	}
-
-	utMetadata := Map["m"].(map[string]interface{})["ut_metadata"].(int64)
-
-	return utMetadata,size.(int64),nil
-}
\ No newline at end of file
+}
@@ -2,12 +2,15 @@ package collect
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,7 +25,10 @@ func (this *Request) Address() string{
 	return this.IP + ":" + strconv.Itoa(this.Port)
 }
 
-var TimeoutError = errors.New("dial timeout")
+var (
+	TimeoutError = errors.New("dial timeout")
+	InfoHashMismatchError = errors.New("metadata does not match infohash")
+)
 
 type metadataQuery struct {
 	*Request
@@ -42,7 +48,8 @@ func newMetadataQuery (request *Request) *metadataQuery{
 }
 
 func (this *metadataQuery) work(collector *Collector){
-	this.err = this.getMetadata()
+	defer collector.queries.Done()
+	this.err = this.getMetadata(collector.ctx)
 	select {
 	case <-collector.closeEvent:
 	case collector.HandleQueryEvent <- struct{}{}:
@@ -72,7 +79,7 @@ const(
 	maxPieceN = 10000
 )
 
-func (this *metadataQuery) getMetadata()error{
+func (this *metadataQuery) getMetadata(ctx context.Context)error{
 	defer func() {
 		if err := recover(); err != nil{
 			log.Println("query error")
@@ -80,10 +87,16 @@ func (this *metadataQuery) getMetadata()error{
 		}
 	}()
 
-	conn,err := net.DialTimeout("tcp",this.Address(),dialTimeout)
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn,err := dialer.DialContext(ctx,"tcp",this.Address())
 	if err != nil{
 		return err
 	}
+	// Closing the connection unblocks any read or write when ctx ends.
+	stop := context.AfterFunc(ctx,func() {
+		conn.Close()
+	})
+	defer stop()
 	tcp := conn.(*net.TCPConn)
 	tcp.SetLinger(0)
 	defer tcp.Close()
@@ -133,19 +146,19 @@ getPieces:   // loop label
 		case <-time.After(getPieceTimeout):
 			return TimeoutError
 		default:
-			buffer.Reset()
-
-			begin, _ , err := readMessage(conn,buffer)
+			id, _ , payload, err := readMessage(conn,buffer)
 
 			if err != nil{
 				return err
 			}
-			if begin != 20{
-				buffer.Reset()
+			if id != extendedID{
+				if err := skipMessage(payload); err != nil{
+					return err
+				}
 				continue
 			}
 
-			Type,pieceID,_,offset,err := extractPieceInfo(buffer.Bytes())
+			Type,pieceID,piece,err := readPiece(payload)
 
 			if err != nil{
 				return err
@@ -154,10 +167,12 @@ getPieces:   // loop label
 			if Type == rejectType{
 				return errors.New("rejected")
 			}else if Type == dataType{
-				piece , _ := ioutil.ReadAll(buffer)
-				pieces[pieceID] = piece[offset:]
+				if pieceID < 0 || pieceID >= len(pieces){
+					return errors.New("invalid piece")
+				}
+				pieces[pieceID] = piece
 
-				if int64(len(piece[offset:])) < BLOCKSIZE{
+				if int64(len(piece)) < BLOCKSIZE{
 					break getPieces
 				}
 			}
@@ -165,6 +180,11 @@ getPieces:   // loop label
 	}
 
 	temp := bytes.Join(pieces,nil)
+	hash := sha1.Sum(temp)
+	if !strings.EqualFold(hex.EncodeToString(hash[:]),this.InfoHash){
+		return InfoHashMismatchError
+	}
+
 	this.result,err = NewTorrent(temp)
 	return err
 }
\ No newline at end of file
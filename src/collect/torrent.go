@@ -2,19 +2,21 @@ package collect
 
 import (
 	"bencode"
+	"crypto/sha1"
 	"encoding/hex"
-	"errors"
+	"io"
+	"strings"
 )
 
 type Torrent struct {
-	rawData		interface{}
-
 	Announce 	string  		//A string pointing to the tracker
 	Files 		[]TorrentFile
 	Length		int64	//文件的大小
 	Name		string  //name of root file or folder
 	PieceLength  int64   //整数,是BitTorrent文件块的大小.
 	Pieces		string	//连续的存放着所有块的SHA1杂凑值,每一个文件块的杂凑值为20字节.
+
+	Info		bencode.RawMessage	// the info dictionary exactly as received
 }
 
 type TorrentFile struct {
@@ -22,57 +24,96 @@ type TorrentFile struct {
 	Path 		string		//由字符串组成的列表,每个列表元素指一个路径名中的一个目录或文件名.比如说:"l3:abc3:abc:6abc.txte",指文件路径"abc/abc/abc.txt".
 }
 
+// torrentInfo is the info dictionary as it appears in the metadata.
+type torrentInfo struct {
+	Name        string `bencode:"name"`
+	Length      int64  `bencode:"length"`
+	PieceLength int64  `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
+	Files       []struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	} `bencode:"files"`
+}
+
+// torrentOptions bounds the nesting of the metadata we parse.
+var torrentOptions = bencode.DecoderOptions{
+	MaxDepth:	16,
+}
+
+// metainfo is the top-level dictionary of a .torrent file.
+type metainfo struct {
+	Announce string             `bencode:"announce,omitempty"`
+	Info     bencode.RawMessage `bencode:"info"`
+}
+
+// NewTorrent parses the info dictionary fetched from a peer.
 func NewTorrent(data []byte) (*Torrent,error){
-	metadata,err := bencode.Unmarshal(data)
+	var raw bencode.RawMessage
+	if err := torrentOptions.Unmarshal(data,&raw); err != nil{
+		return nil,err
+	}
+	return parseInfo(raw)
+}
+
+// ReadTorrent decodes a .torrent file from r without reading it into memory
+// first.
+func ReadTorrent(r io.Reader) (*Torrent,error){
+	var file metainfo
+	if err := torrentOptions.NewDecoder(r).Decode(&file); err != nil{
+		return nil,err
+	}
+	ret,err := parseInfo(file.Info)
 	if err != nil{
 		return nil,err
 	}
+	ret.Announce = file.Announce
+	return ret,nil
+}
 
-	ret := Torrent{}
+// InfoHash returns the hex-encoded SHA-1 of the raw info dictionary.
+func (this *Torrent) InfoHash() string{
+	hash := sha1.Sum(this.Info)
+	return hex.EncodeToString(hash[:])
+}
 
-	ret.rawData = map[string]interface{}{
-		"info" : metadata,
-	}
-	Map,ok := ret.rawData.(map[string]interface{})    //A dictionary
+// Encode writes the torrent to w as a .torrent file, with the info
+// dictionary unchanged so that the infohash stays the same.
+func (this *Torrent) Encode(w io.Writer) error{
+	return bencode.NewEncoder(w).Encode(&metainfo{
+		Announce:	this.Announce,
+		Info:		this.Info,
+	})
+}
 
-	if !ok{
-		return nil,errors.New("Invalid Metadata")
+func parseInfo(raw bencode.RawMessage) (*Torrent,error){
+	var info torrentInfo
+	if err := torrentOptions.Unmarshal(raw,&info); err != nil{
+		return nil,err
 	}
+	ret := newTorrent(&info)
+	ret.Info = raw
+	return ret,nil
+}
 
-	if announce, ok := Map["announce"].([]byte); ok{
-		ret.Announce = string(announce)
+func newTorrent(info *torrentInfo) *Torrent{
+	ret := Torrent{
+		Name:			info.Name,				// name of root folder
+		Length:			info.Length,
+		PieceLength:	info.PieceLength,		// size of per piece
+		Pieces:			hex.EncodeToString(info.Pieces),	// SHA-1 hash value of all peices
 	}
 
-	if info, ok := Map["info"].(map[string]interface{}); ok{
-		// name of root folder
-		if name,ok := info["name"].([]byte); ok {
-			ret.Name = string(name)
-		}
-		// size of per piece
-		if pieceLen, ok := info["piece length"].(int64); ok{
-			ret.PieceLength = pieceLen
-		}
-		// SHA-1 hash value of all peices
-		if pieces, ok := info["pieces"].([]byte); ok {
-			ret.Pieces = hex.EncodeToString(pieces)
-		}
-		// files
-		if files, ok := info["files"].([]interface{}); ok {
-			fileN := len(files)
-			ret.Files = make([]TorrentFile,0,fileN)
-			for i:=0 ;i<fileN;i++{
-				if file,ok := files[i].(map[string]interface{}); ok {
-					File := TorrentFile{}
-					if Len, ok := file["length"].(int64); ok {
-						File.Length = Len
-					}
-					if path,ok := file["path"].([]interface{}); ok{
-						File.Path = string(path[0].([]byte))
-						ret.Files = append(ret.Files,File)
-					}
-				}
-			}
+	// files
+	ret.Files = make([]TorrentFile,0,len(info.Files))
+	for _,file := range info.Files{
+		if len(file.Path) == 0{
+			continue
 		}
+		ret.Files = append(ret.Files,TorrentFile{
+			Length:	file.Length,
+			Path:	strings.Join(file.Path,"/"),
+		})
 	}
-	return &ret,nil
-}
\ No newline at end of file
+	return &ret
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Blocklist is a set of IP ranges. It reads one range per line, either as
+// a CIDR block, a single IP, "first-last", or in PeerGuardian format
+// ("description:first-last"). Blank lines and lines starting with # are
+// skipped.
+type Blocklist struct {
+	ranges		[]ipRange	// sorted and disjoint
+}
+
+// ipRange holds its bounds in 16-byte form.
+type ipRange struct {
+	first,last	net.IP
+}
+
+func LoadBlocklist(path string) (*Blocklist,error){
+	f,err := os.Open(path)
+	if err != nil{
+		return nil,err
+	}
+	defer f.Close()
+	return ParseBlocklist(f)
+}
+
+func ParseBlocklist(r io.Reader) (*Blocklist,error){
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++{
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line,"#"){
+			continue
+		}
+		ipr,ok := parseRange(line)
+		if !ok{
+			return nil,fmt.Errorf("blocklist line %d: invalid range %q",n,line)
+		}
+		ranges = append(ranges,ipr)
+	}
+	if err := scanner.Err(); err != nil{
+		return nil,err
+	}
+
+	sort.Slice(ranges,func(i,j int) bool{
+		return bytes.Compare(ranges[i].first,ranges[j].first) < 0
+	})
+	merged := ranges[:0]
+	for _,o := range ranges{
+		if l := len(merged) - 1; l >= 0 && bytes.Compare(o.first,merged[l].last) <= 0{
+			if bytes.Compare(o.last,merged[l].last) > 0{
+				merged[l].last = o.last
+			}
+			continue
+		}
+		merged = append(merged,o)
+	}
+	return &Blocklist{merged},nil
+}
+
+// parseRange reads one line. A range is recognized by its dash first, as
+// a PeerGuardian description may contain anything, slashes included; only
+// a line without one can be a CIDR block.
+func parseRange(line string) (ipRange,bool){
+	dash := strings.LastIndex(line,"-")
+	if dash < 0 && strings.Contains(line,"/"){
+		_,ipnet,err := net.ParseCIDR(line)
+		if err != nil{
+			return ipRange{},false
+		}
+		last := make(net.IP,len(ipnet.IP))
+		for i := range last{
+			last[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+		}
+		return ipRange{ipnet.IP.To16(),last.To16()},true
+	}
+
+	first,last := line,line
+	if dash >= 0{
+		first,last = line[:dash],line[dash+1:]
+		// PeerGuardian: the description ends at the last colon.
+		if net.ParseIP(first) == nil{
+			first = first[strings.LastIndex(first,":") + 1:]
+		}
+	}
+	ipr := ipRange{net.ParseIP(strings.TrimSpace(first)),net.ParseIP(strings.TrimSpace(last))}
+	if ipr.first == nil || ipr.last == nil || (ipr.first.To4() == nil) != (ipr.last.To4() == nil) ||
+		bytes.Compare(ipr.first,ipr.last) > 0{
+		return ipRange{},false
+	}
+	return ipr,true
+}
+
+// Contains reports whether ip is in one of the ranges. A nil Blocklist
+// contains nothing.
+func (this *Blocklist) Contains(ip net.IP) bool{
+	if this == nil{
+		return false
+	}
+	ip = ip.To16()
+	if ip == nil{
+		return false
+	}
+	i := sort.Search(len(this.ranges),func(i int) bool{
+		return bytes.Compare(this.ranges[i].first,ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip,this.ranges[i-1].last) <= 0
+}
+
+// Len returns the number of disjoint ranges.
+func (this *Blocklist) Len() int{
+	if this == nil{
+		return 0
+	}
+	return len(this.ranges)
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T){
+	list := `# comment
+Foo Corp/ISP:1.2.3.0-1.2.3.255
+Some-Org, Inc.:10.0.0.5-10.0.0.9
+192.168.0.0/16
+8.8.8.8
+172.16.0.1 - 172.16.0.3
+2001:db8::/32
+
+20.0.0.0-20.0.0.10
+20.0.0.5-20.0.1.0
+`
+	b,err := ParseBlocklist(strings.NewReader(list))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if b.Len() != 7{
+		t.Errorf("Len() = %d, want 7",b.Len())
+	}
+
+	for _,c := range []struct {
+		ip			string
+		blocked		bool
+	}{
+		{"1.2.3.0",true},
+		{"1.2.3.255",true},
+		{"1.2.4.0",false},
+		{"10.0.0.4",false},
+		{"10.0.0.7",true},
+		{"192.168.77.1",true},
+		{"8.8.8.8",true},
+		{"8.8.8.9",false},
+		{"172.16.0.3",true},
+		{"2001:db8:1::1",true},
+		{"2001:db9::1",false},
+		{"20.0.0.200",true},
+		{"20.0.1.1",false},
+	}{
+		if got := b.Contains(net.ParseIP(c.ip)); got != c.blocked{
+			t.Errorf("Contains(%s) = %v, want %v",c.ip,got,c.blocked)
+		}
+	}
+}
+
+func TestParseBlocklistInvalid(t *testing.T){
+	for _,line := range []string{
+		"Foo:1.2.3.0",
+		"1.2.3.0-1.2.2.0",
+		"1.2.3.0-2001:db8::1",
+		"1.2.3.0/33",
+		"Foo/Bar",
+	}{
+		if _,err := ParseBlocklist(strings.NewReader(line)); err == nil{
+			t.Errorf("%q parsed",line)
+		}
+	}
+
+	var b *Blocklist
+	if b.Contains(net.IPv4(1,2,3,4)) || b.Len() != 0{
+		t.Error("nil Blocklist is not empty")
+	}
+}
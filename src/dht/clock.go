@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+// PacketConn is the socket a node sends and receives KRPC packets on.
+// *net.UDPConn implements it; dhttest provides an in-memory one.
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int,*net.UDPAddr,error)
+	WriteToUDP(b []byte,addr *net.UDPAddr) (int,error)
+	SetWriteDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	Close() error
+}
+
+func listenUDP(network string,laddr *net.UDPAddr) (PacketConn,error){
+	conn,err := net.ListenUDP(network,laddr)
+	if err != nil{
+		return nil,err
+	}
+	return conn,nil
+}
+
+// Clock is the time source of the node: every timer, timeout and rate
+// goes through it, so that a virtual clock can drive the node in tests.
+// Only socket deadlines use the system clock.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration,f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer started by Clock.AfterFunc.
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker delivers ticks on Chan until it is stopped.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// after returns a channel that receives the time once d has passed on
+// clock, and the timer to stop it with.
+func after(clock Clock,d time.Duration) (<-chan time.Time,Timer){
+	ch := make(chan time.Time,1)
+	t := clock.AfterFunc(d,func() {
+		ch <- clock.Now()
+	})
+	return ch,t
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time{
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration,f func()) Timer{
+	return time.AfterFunc(d,f)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker{
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (this systemTicker) Chan() <-chan time.Time{
+	return this.C
+}
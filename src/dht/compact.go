@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Compact encodings of BEP 5 and BEP 32. Ports are in network byte order.
+
+var ErrCompactLength = errors.New("invalid compact info length")
+
+// CompactPeerInfo is a peer as sent in the "values" of a get_peers response:
+// the IP followed by the port, 6 bytes for IPv4 and 18 bytes for IPv6.
+type CompactPeerInfo struct {
+	IP		net.IP
+	Port	int
+}
+
+// Encode returns the compact form of the peer.
+func (this CompactPeerInfo) Encode() []byte{
+	ip := this.IP
+	if ip4 := ip.To4(); ip4 != nil{
+		ip = ip4
+	}
+	data := make([]byte,len(ip) + 2)
+	copy(data,ip)
+	binary.BigEndian.PutUint16(data[len(ip):],uint16(this.Port))
+	return data
+}
+
+// TCPAddr returns the address to dial the peer at.
+func (this CompactPeerInfo) TCPAddr() *net.TCPAddr{
+	return &net.TCPAddr{IP: this.IP,Port: this.Port}
+}
+
+// DecodeCompactPeerInfo decodes a 6-byte or 18-byte compact peer.
+func DecodeCompactPeerInfo(data []byte) (CompactPeerInfo,error){
+	switch len(data) {
+	case net.IPv4len + 2, net.IPv6len + 2:
+	default:
+		return CompactPeerInfo{},ErrCompactLength
+	}
+	ipLen := len(data) - 2
+	ip := make(net.IP,ipLen)
+	copy(ip,data)
+	return CompactPeerInfo{
+		IP:		ip,
+		Port:	int(binary.BigEndian.Uint16(data[ipLen:])),
+	},nil
+}
+
+// CompactNodeInfo is a node as sent in "nodes" and "nodes6": the 20-byte
+// node ID followed by the compact address, 26 bytes for IPv4 and 38 bytes
+// for IPv6.
+type CompactNodeInfo struct {
+	ID		IDType
+	Addr	net.UDPAddr
+}
+
+// Encode returns the compact form of the node.
+func (this CompactNodeInfo) Encode() []byte{
+	peer := CompactPeerInfo{this.Addr.IP,this.Addr.Port}
+	return append(this.ID[:len(this.ID):len(this.ID)],peer.Encode()...)
+}
+
+// DecodeCompactNodeInfo decodes a 26-byte or 38-byte compact node.
+func DecodeCompactNodeInfo(data []byte) (CompactNodeInfo,error){
+	var ret CompactNodeInfo
+	if len(data) < len(ret.ID){
+		return ret,ErrCompactLength
+	}
+	peer,err := DecodeCompactPeerInfo(data[len(ret.ID):])
+	if err != nil{
+		return ret,err
+	}
+	copy(ret.ID[:],data)
+	ret.Addr = net.UDPAddr{IP: peer.IP,Port: peer.Port}
+	return ret,nil
+}
+
+// EncodeCompactNodes concatenates the nodes whose IP has ipLen bytes, as in
+// "nodes" (net.IPv4len) or "nodes6" (net.IPv6len). Other nodes are skipped.
+func EncodeCompactNodes(nodes []CompactNodeInfo,ipLen int) []byte{
+	size := len(IDType{}) + ipLen + 2
+	data := make([]byte,0,size * len(nodes))
+	for _,o := range nodes{
+		if (o.Addr.IP.To4() != nil) != (ipLen == net.IPv4len){
+			continue
+		}
+		data = append(data,o.Encode()...)
+	}
+	return data
+}
+
+// DecodeCompactNodes splits a "nodes" or "nodes6" string into nodes whose IP
+// has ipLen bytes.
+func DecodeCompactNodes(data []byte,ipLen int) ([]CompactNodeInfo,error){
+	size := len(IDType{}) + ipLen + 2
+	if len(data) % size != 0{
+		return nil,ErrCompactLength
+	}
+	ret := make([]CompactNodeInfo,0,len(data)/size)
+	for i := 0; i < len(data); i += size{
+		o,err := DecodeCompactNodeInfo(data[i:i+size])
+		if err != nil{
+			return nil,err
+		}
+		ret = append(ret,o)
+	}
+	return ret,nil
+}
+
+func encodeCompactForm(nodes []*node,ipLen int) []byte{
+	infos := make([]CompactNodeInfo,len(nodes))
+	for i,o := range nodes{
+		infos[i] = CompactNodeInfo{o.id,o.addr}
+	}
+	return EncodeCompactNodes(infos,ipLen)
+}
+
+func decodeCompactNodes(data []byte,ipLen int) []*node{
+	infos,err := DecodeCompactNodes(data,ipLen)
+	if err != nil{
+		return nil
+	}
+	ret := make([]*node,len(infos))
+	for i,o := range infos{
+		ret[i] = &node{o.ID,o.Addr}
+	}
+	return ret
+}
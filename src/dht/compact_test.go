@@ -0,0 +1,155 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var testNodeID = IDType{'a','b','c','d','e','f','g','h','i','j','0','1','2','3','4','5','6','7','8','9'}
+
+// Golden compact forms. The ports are 6881 (0x1ae1) and 258 (0x0102), in
+// network byte order.
+var compactPeerVectors = []struct {
+	peer	CompactPeerInfo
+	data	[]byte
+}{
+	{
+		CompactPeerInfo{net.IPv4(192,168,1,1),6881},
+		[]byte{192,168,1,1,0x1a,0xe1},
+	},
+	{
+		CompactPeerInfo{net.IPv4(10,0,0,2),258},
+		[]byte{10,0,0,2,0x01,0x02},
+	},
+	{
+		CompactPeerInfo{net.ParseIP("2001:db8::1"),6881},
+		[]byte{0x20,0x01,0x0d,0xb8,0,0,0,0,0,0,0,0,0,0,0,1,0x1a,0xe1},
+	},
+}
+
+func TestCompactPeerInfo(t *testing.T){
+	for _,v := range compactPeerVectors{
+		if data := v.peer.Encode(); !bytes.Equal(data,v.data){
+			t.Errorf("Encode(%v:%d) = %x, want %x",v.peer.IP,v.peer.Port,data,v.data)
+		}
+		peer,err := DecodeCompactPeerInfo(v.data)
+		if err != nil{
+			t.Errorf("DecodeCompactPeerInfo(%x): %v",v.data,err)
+			continue
+		}
+		if !peer.IP.Equal(v.peer.IP) || peer.Port != v.peer.Port{
+			t.Errorf("DecodeCompactPeerInfo(%x) = %v:%d, want %v:%d",v.data,peer.IP,peer.Port,v.peer.IP,v.peer.Port)
+		}
+	}
+
+	for _,n := range []int{0,5,7,17,19}{
+		if _,err := DecodeCompactPeerInfo(make([]byte,n)); err != ErrCompactLength{
+			t.Errorf("DecodeCompactPeerInfo of %d bytes: got %v, want ErrCompactLength",n,err)
+		}
+	}
+}
+
+func TestCompactNodeInfo(t *testing.T){
+	for _,v := range compactPeerVectors{
+		o := CompactNodeInfo{testNodeID,net.UDPAddr{IP: v.peer.IP,Port: v.peer.Port}}
+		want := append(append([]byte(nil),testNodeID[:]...),v.data...)
+		data := o.Encode()
+		if !bytes.Equal(data,want){
+			t.Errorf("Encode(%v) = %x, want %x",&o.Addr,data,want)
+		}
+		if len(data) != 26 && len(data) != 38{
+			t.Errorf("compact node of %d bytes",len(data))
+		}
+
+		got,err := DecodeCompactNodeInfo(data)
+		if err != nil{
+			t.Errorf("DecodeCompactNodeInfo(%x): %v",data,err)
+			continue
+		}
+		if got.ID != o.ID || !got.Addr.IP.Equal(o.Addr.IP) || got.Addr.Port != o.Addr.Port{
+			t.Errorf("DecodeCompactNodeInfo(%x) = %x %v, want %x %v",data,got.ID,&got.Addr,o.ID,&o.Addr)
+		}
+	}
+}
+
+func TestCompactNodes(t *testing.T){
+	nodes := []CompactNodeInfo{
+		{testNodeID,net.UDPAddr{IP: net.IPv4(1,2,3,4),Port: 1}},
+		{IDType{1},net.UDPAddr{IP: net.ParseIP("2001:db8::2"),Port: 2}},
+		{IDType{2},net.UDPAddr{IP: net.IPv4(5,6,7,8),Port: 65535}},
+	}
+
+	for _,family := range []struct {
+		ipLen	int
+		want	[]CompactNodeInfo
+	}{
+		{net.IPv4len,[]CompactNodeInfo{nodes[0],nodes[2]}},
+		{net.IPv6len,[]CompactNodeInfo{nodes[1]}},
+	}{
+		data := EncodeCompactNodes(nodes,family.ipLen)
+		if size := len(family.want) * (20 + family.ipLen + 2); len(data) != size{
+			t.Fatalf("EncodeCompactNodes for %d-byte IPs: %d bytes, want %d",family.ipLen,len(data),size)
+		}
+		got,err := DecodeCompactNodes(data,family.ipLen)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if len(got) != len(family.want){
+			t.Fatalf("DecodeCompactNodes: %d nodes, want %d",len(got),len(family.want))
+		}
+		for i := range got{
+			w := family.want[i]
+			if got[i].ID != w.ID || !got[i].Addr.IP.Equal(w.Addr.IP) || got[i].Addr.Port != w.Addr.Port{
+				t.Errorf("node %d = %x %v, want %x %v",i,got[i].ID,&got[i].Addr,w.ID,&w.Addr)
+			}
+		}
+	}
+
+	if _,err := DecodeCompactNodes(make([]byte,27),net.IPv4len); err != ErrCompactLength{
+		t.Errorf("DecodeCompactNodes of 27 bytes: got %v, want ErrCompactLength",err)
+	}
+}
+
+// A get_peers response carries its peers as a list of compact strings in
+// "values", and the querier's address in "ip".
+func TestResponseValues(t *testing.T){
+	raw := "d2:ip6:" + string([]byte{1,2,3,4,0x1a,0xe1}) +
+		"1:rd2:id20:" + string(testNodeID[:]) +
+		"5:token4:abcd6:valuesl6:" + string(compactPeerVectors[0].data) +
+		"6:" + string(compactPeerVectors[1].data) + "ee1:t2:aa1:y1:re"
+	msg,err := decodeMessage([]byte(raw),decoderOptions(DefaultConfig()))
+	if err != nil{
+		t.Fatal(err)
+	}
+	R := &KRPCResponse{Type: GetPeersType}
+	if err := R.LoadFromMessage(msg); err != nil{
+		t.Fatal(err)
+	}
+
+	if R.queryID != testNodeID || R.token != "abcd"{
+		t.Errorf("got id %x token %q",R.queryID,R.token)
+	}
+	if len(R.values) != 2{
+		t.Fatalf("got %d values, want 2",len(R.values))
+	}
+	for i,v := range R.values{
+		want := compactPeerVectors[i].peer
+		if !v.IP.Equal(want.IP) || v.Port != want.Port{
+			t.Errorf("value %d = %v:%d, want %v:%d",i,v.IP,v.Port,want.IP,want.Port)
+		}
+	}
+	if R.ip == nil || !R.ip.IP.Equal(net.IPv4(1,2,3,4)) || R.ip.Port != 6881{
+		t.Errorf("ip = %v, want 1.2.3.4:6881",R.ip)
+	}
+
+	// and it encodes back to the same values
+	R.transactionID = []byte("aa")
+	data,err := R.Encode()
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data,[]byte("6:valuesl6:" + string(compactPeerVectors[0].data))){
+		t.Errorf("encoded response %q lacks the values",data)
+	}
+}
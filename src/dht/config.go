@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"log"
+	"math/rand"
+	"nat"
+	"net"
+	"sync"
+	"time"
+)
+
+var bootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// Config holds the settings of a DHTNode. Start from DefaultConfig; zero
+// sizes, durations, Logger, Rand, Clock and Listen are replaced by their
+// defaults: the system clock and net.ListenUDP.
+type Config struct {
+	BootstrapNodes	[]string		// routers used when we know no nodes
+	K				int				// bucket size and size of lookup results
+	Alpha			int				// queries in flight during a lookup
+	SecureIDs		bool			// prefer nodes with BEP 42 IDs when a bucket is full
+
+	QueryTimeout	time.Duration	// wait for an answer before resending
+	QueryRetries	int				// resends of an unanswered query
+	PingInterval	time.Duration	// quiet time after which a node is pinged
+	RefreshInterval	time.Duration	// quiet time after which a bucket is refreshed
+
+	StateFile		string			// where to save the routing table; empty disables it
+	ReadBufferSize	int				// largest UDP packet read
+	WriteTimeout	time.Duration	// deadline for sending a packet
+
+	MaxPacketRate	float64			// packets sent per second in total; negative for no limit
+	SendRates		map[string]float64	// packets per second by query method or ResponseKind; others are unlimited
+	MaxSendDelay	time.Duration	// longest a query is held back before it is dropped; replies are never held
+
+	Workers			int				// goroutines handling received packets
+	QueueSize		int				// received packets waiting for a worker; more are dropped
+	MaxPacketsPerIP	float64			// packets per second accepted from one IP; negative for no limit
+	BanThreshold	int				// malformed packets after which an IP is banned
+	BanDuration		time.Duration	// how long a ban lasts
+	Blocklist		*Blocklist		// IP ranges ignored entirely, and never passed to PeerHandler
+
+	MaxSwarmPeers	int				// peer store cap per infohash
+	MaxPeers		int				// peer store cap in total
+
+	Identities		int				// virtual node IDs of crawler mode; 0 runs one ID
+	NeighborIDs		bool			// crawler mode: pose as a neighbor of each target
+
+	PortMapper		nat.Mapper		// maps our port on the NAT gateway; nil disables it
+
+	Logger			*log.Logger
+	Rand			rand.Source		// source of node IDs and transaction IDs
+	Clock			Clock			// time source of every timer, timeout and rate
+	Listen			func(network string,laddr *net.UDPAddr) (PacketConn,error)	// opens the sockets
+}
+
+// DefaultConfig returns the settings NewNode uses for a nil Config.
+func DefaultConfig() *Config{
+	return &Config{
+		BootstrapNodes:		bootstrapNodes,
+		K:					8,
+		Alpha:				3,
+		QueryTimeout:		2 * time.Second,
+		QueryRetries:		2,
+		PingInterval:		15 * time.Minute,
+		RefreshInterval:	15 * time.Minute,
+		StateFile:			"data",
+		ReadBufferSize:		maxPacketSize,
+		WriteTimeout:		5 * time.Second,
+		MaxPacketRate:		500,
+		SendRates:			map[string]float64{
+			PingType:			50,
+			FindNodeType:		200,
+			GetPeersType:		100,
+			AnnoucePeerType:	20,
+		},
+		MaxSendDelay:		1 * time.Second,
+		Workers:			32,
+		QueueSize:			1024,
+		MaxPacketsPerIP:	20,
+		BanThreshold:		3,
+		BanDuration:		10 * time.Minute,
+		MaxSwarmPeers:		200,
+		MaxPeers:			100000,
+	}
+}
+
+// withDefaults returns a copy of config with unset fields filled in.
+func (config *Config) withDefaults() *Config{
+	def := DefaultConfig()
+	if config == nil{
+		config = def
+	}
+	ret := *config
+	if ret.K <= 0{
+		ret.K = def.K
+	}
+	if ret.Alpha <= 0{
+		ret.Alpha = def.Alpha
+	}
+	if ret.QueryTimeout <= 0{
+		ret.QueryTimeout = def.QueryTimeout
+	}
+	if ret.QueryRetries < 0{
+		ret.QueryRetries = 0
+	}
+	if ret.PingInterval <= 0{
+		ret.PingInterval = def.PingInterval
+	}
+	if ret.RefreshInterval <= 0{
+		ret.RefreshInterval = def.RefreshInterval
+	}
+	if ret.ReadBufferSize <= 0{
+		ret.ReadBufferSize = def.ReadBufferSize
+	}
+	if ret.WriteTimeout <= 0{
+		ret.WriteTimeout = def.WriteTimeout
+	}
+	if ret.MaxPacketRate == 0{
+		ret.MaxPacketRate = def.MaxPacketRate
+	}
+	if ret.SendRates == nil{
+		ret.SendRates = def.SendRates
+	}
+	if ret.MaxSendDelay <= 0{
+		ret.MaxSendDelay = def.MaxSendDelay
+	}
+	if ret.Workers <= 0{
+		ret.Workers = def.Workers
+	}
+	if ret.QueueSize <= 0{
+		ret.QueueSize = def.QueueSize
+	}
+	if ret.MaxPacketsPerIP == 0{
+		ret.MaxPacketsPerIP = def.MaxPacketsPerIP
+	}
+	if ret.BanThreshold <= 0{
+		ret.BanThreshold = def.BanThreshold
+	}
+	if ret.BanDuration <= 0{
+		ret.BanDuration = def.BanDuration
+	}
+	if ret.MaxSwarmPeers <= 0{
+		ret.MaxSwarmPeers = def.MaxSwarmPeers
+	}
+	if ret.MaxPeers <= 0{
+		ret.MaxPeers = def.MaxPeers
+	}
+	if ret.Identities < 0{
+		ret.Identities = 0
+	}
+	if ret.Logger == nil{
+		ret.Logger = log.Default()
+	}
+	if ret.Rand == nil{
+		ret.Rand = rand.NewSource(time.Now().UnixNano())
+	}
+	if ret.Clock == nil{
+		ret.Clock = systemClock{}
+	}
+	if ret.Listen == nil{
+		ret.Listen = listenUDP
+	}
+	return &ret
+}
+
+// lockedRand makes a rand.Source safe for the node's goroutines.
+type lockedRand struct {
+	mu	sync.Mutex
+	r	*rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand{
+	return &lockedRand{r: rand.New(src)}
+}
+
+func (this *lockedRand) id() IDType{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var ret IDType
+	this.r.Read(ret[:])
+	return ret
+}
+
+func (this *lockedRand) intn(n int) int{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.r.Intn(n)
+}
@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// In crawler mode a node answers and queries under many virtual IDs spread
+// across the keyspace, so that it lands in many more routing tables and sees
+// the announces of many more infohashes than a single ID would. All virtual
+// nodes share the node's sockets, routing tables and PeerHandler.
+
+// identity is one virtual node of a crawler.
+type identity struct {
+	id			IDType
+	queries		atomic.Int64	// queries answered under this ID
+	getPeers	atomic.Int64	// get_peers among them
+	announces	atomic.Int64	// announce_peer among them
+	sent		atomic.Int64	// find_node queries sent to advertise it
+}
+
+// IdentityStats are the counters of one virtual node.
+type IdentityStats struct {
+	ID			IDType
+	Queries		int64
+	GetPeers	int64
+	Announces	int64
+	Sent		int64
+}
+
+type identitySet struct {
+	mu			sync.RWMutex
+	list		[]*identity
+	next		int				// round robin for outgoing queries
+}
+
+// spreadIDs returns n random IDs, the i-th of which falls in the i-th of n
+// equal slices of the keyspace.
+func spreadIDs(rnd *lockedRand,n int) []IDType{
+	ret := make([]IDType,n)
+	for i := range ret{
+		id := rnd.id()
+		offset := uint64(binary.BigEndian.Uint32(id[:4]))
+		binary.BigEndian.PutUint32(id[:4],uint32((uint64(i) << 32 + offset) / uint64(n)))
+		ret[i] = id
+	}
+	return ret
+}
+
+// neighborID is an ID sharing its first 15 bytes with target: the node
+// that knows target puts it in its closest bucket.
+func neighborID(target,id IDType) IDType{
+	copy(id[:15],target[:15])
+	return id
+}
+
+// SetIdentities switches crawler mode to n virtual IDs, or off for n = 0.
+// The counters of the previous IDs are discarded.
+func (this *DHTNode) SetIdentities(n int){
+	if n < 0{
+		n = 0
+	}
+	var list []*identity
+	for _,id := range spreadIDs(this.rand,n){
+		list = append(list,&identity{id: id})
+	}
+	this.identities.mu.Lock()
+	this.identities.list = list
+	this.identities.next = 0
+	this.identities.mu.Unlock()
+}
+
+// Identities returns the counters of the virtual IDs in crawler mode.
+func (this *DHTNode) Identities() []IdentityStats{
+	this.identities.mu.RLock()
+	defer this.identities.mu.RUnlock()
+	ret := make([]IdentityStats,len(this.identities.list))
+	for i,o := range this.identities.list{
+		ret[i] = IdentityStats{
+			ID:			o.id,
+			Queries:	o.queries.Load(),
+			GetPeers:	o.getPeers.Load(),
+			Announces:	o.announces.Load(),
+			Sent:		o.sent.Load(),
+		}
+	}
+	return ret
+}
+
+// closestIdentity returns the virtual ID closest to target, or nil outside
+// crawler mode.
+func (this *DHTNode) closestIdentity(target IDType) *identity{
+	this.identities.mu.RLock()
+	defer this.identities.mu.RUnlock()
+	var ret *identity
+	for _,o := range this.identities.list{
+		if ret == nil || closer(&target,&o.id,&ret.id) < 0{
+			ret = o
+		}
+	}
+	return ret
+}
+
+// responseID is the ID we answer a query about target with, and counts the
+// query for the virtual node answering it.
+func (this *DHTNode) responseID(queryType string,target IDType) IDType{
+	o := this.closestIdentity(target)
+	if o == nil{
+		return this.ID()
+	}
+	o.queries.Add(1)
+	switch queryType {
+	case GetPeersType:
+		o.getPeers.Add(1)
+	case AnnoucePeerType:
+		o.announces.Add(1)
+	}
+	if this.config.NeighborIDs{
+		return neighborID(target,o.id)
+	}
+	return o.id
+}
+
+// queryID is the ID we send a query to the node remote with. Crawler mode
+// takes the virtual IDs in turn.
+func (this *DHTNode) queryID(remote IDType) IDType{
+	this.identities.mu.Lock()
+	defer this.identities.mu.Unlock()
+	if len(this.identities.list) == 0{
+		return this.ID()
+	}
+	o := this.identities.list[this.identities.next % len(this.identities.list)]
+	this.identities.next++
+	o.sent.Add(1)
+	if this.config.NeighborIDs{
+		return neighborID(remote,o.id)
+	}
+	return o.id
+}
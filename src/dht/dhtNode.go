@@ -1,61 +1,82 @@
 package dht
 
 import (
+	"bencode"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
-	"os/signal"
+	"sync"
 	"time"
 )
 
-var bootstrapNodes = []string{
-	"router.bittorrent.com:6881",
-	"dht.transmissionbt.com:6881",
-	"router.utorrent.com:6881",
-	"dht.libtorrent.org:25401",
-}
-
-var random = rand.New(rand.NewSource(19260817))
-
-func generateID() IDType{
-	temp := make([]byte,20)
-	random.Read(temp)
-	var ret IDType
-	copy(ret[:],temp[:])
-	return ret
-}
-
-func GenerateToken() []byte{
-	buf := make([]byte,2)
-	random.Read(buf)
-	return buf
-}
-
 type DHTNode struct {
 	node
 	localAddress 	net.UDPAddr
 	RT 				*routingTable
-	udpconn 		*net.UDPConn
-
-	running 		bool
+	RT6				*routingTable	// IPv6 nodes, BEP 32
+	udpconn 		PacketConn
+	udpconn6		PacketConn
+	transactions	*transactionManager
+	Peers			*PeerStore
+	tokens			*tokenManager
+	limiter			*sendLimiter
+	guard			*inboundGuard
+	idMu			sync.RWMutex		// guards node.id, which BEP 42 may change
+	fixedID			bool				// the ID was given to Create
+	externalAddr	*ipVoter			// our address as seen by other nodes
+	packets			chan packet			// received packets waiting for a worker
+	identities		identitySet		// virtual IDs in crawler mode
+
+	config			*Config
+	decoder			bencode.DecoderOptions
+	logger			*log.Logger
+	rand			*lockedRand
+	seeds			[]node
 
 	findNodeEvent 	chan *node
 	quitEvent		chan struct{}
 
-	PeerHandler  func(ip string, port int, infoHash, peerID string)
+	ctx				context.Context		// canceled on shutdown to abort queries
+	cancel			context.CancelFunc
+	goroutines		sync.WaitGroup		// readers, packet handlers and Join
+	closeOnce		sync.Once
+	done			chan struct{}
+
+	// PeerHandler is called for every announce. verified is false when the
+	// announce did not carry a valid token, so the address may be forged.
+	PeerHandler  func(ip string, port int, infoHash, peerID string, verified bool)
 }
 
-func NewNode() *DHTNode{
+// NewNode returns a node with the given settings, or DefaultConfig() if
+// config is nil.
+func NewNode(config *Config) *DHTNode{
+	config = config.withDefaults()
+	rnd := newLockedRand(config.Rand)
+	ctx,cancel := context.WithCancel(context.Background())
 	ret := &DHTNode{
 		node: 					node{},
 		// routingTable will be initialzed in Create()
-		running: 				false,
+		config:					config,
+		decoder:				decoderOptions(config),
+		logger:					config.Logger,
+		rand:					rnd,
+		transactions:			newTransactionManager(rnd),
+		Peers:					newPeerStore(config.MaxSwarmPeers,config.MaxPeers,config.Clock),
+		tokens:					newTokenManager(config.Clock),
+		limiter:				newSendLimiter(config),
+		guard:					newInboundGuard(config),
+		externalAddr:			newIPVoter(),
+		packets:				make(chan packet,config.QueueSize),
 		findNodeEvent:			make(chan *node),
 		quitEvent: 				make(chan struct{}),
+		ctx:					ctx,
+		cancel:					cancel,
+		done:					make(chan struct{}),
 	}
+	ret.SetIdentities(config.Identities)
 
 	return ret
 }
@@ -63,20 +84,38 @@ func NewNode() *DHTNode{
 func (this *DHTNode)handleKRPCPacket(address *net.UDPAddr, raw []byte){
 	defer func(){
 		if err := recover(); err != nil{
-			log.Println("recover: ",err)
+			this.logger.Println("recover: ",err)
 		}
 	}()
 
-	msg,err := decodeMessage(raw)   // msg is a <KRPCMessage> type, data is store in <msg.content> as a map.
+	msg,err := decodeMessage(raw,this.decoder)
 	if err != nil{
-		log.Println("decodeKRPCMessge: ",err)
+		this.logger.Println("decodeKRPCMessge: ",err)
+		// only invalid bencode counts against the sender: well-formed
+		// packets with odd field types just get a protocol error.
+		switch err.(type) {
+		case *bencode.SyntaxError,*bencode.LimitError:
+			this.guard.strike(address.IP)
+		}
+		if msg != nil && msg.isQuery(){
+			this.replyError([]byte(msg.T),address,KRPCErrMalformedPacket)
+		}
+		return
 	}
 
 	if msg.isQuery(){
 		Q := new(KRPCQuery)
-		Q.LoadFormMap(msg.content)
+		if err := Q.LoadFromMessage(msg); err != nil{
+			this.logger.Println("decodeKRPCMessge: ",err)
+			krpcErr,ok := err.(*ErrorType)
+			if !ok{
+				krpcErr = KRPCErrProtocol
+			}
+			this.replyError(Q.transactionID,address,krpcErr)
+			return
+		}
 
-		this.RT.Notify(&node{
+		this.table(address).NotifyQuery(&node{
 			Q.id,
 			*address,
 		})
@@ -90,52 +129,39 @@ func (this *DHTNode)handleKRPCPacket(address *net.UDPAddr, raw []byte){
 		case AnnoucePeerType:
 			this.handleAnounce(Q,address)
 		}
-	}else if msg.isResponse(){
-		R := new(KRPCResponse)
-		R.LoadFromMap(msg.content)
-
-		log.Println("get response: from ",R.queryID)
-
-		this.RT.Notify(&node{
-			R.queryID,
-			*address,
-		})
-
-		if len(R.nodes) > 0 {
-			for _,o := range R.nodes{
-				this.findNodeEvent <- o
-			}
+	}else if msg.isResponse() || msg.isError(){
+		if !this.transactions.deliver(address,msg){
+			this.logger.Println("unexpected reply from ",address)
 		}
 	}else{
-		log.Println(msg)
+		this.logger.Println("unknown message type: ",msg.Y)
 	}
 }
 
-func (this *DHTNode) listenConsole() {
-	ch := make(chan  os.Signal)
-	signal.Notify(ch,os.Interrupt)
-	<-ch
-
-	log.Println("Quit...")
-	close(this.quitEvent)
-	time.Sleep(500 * time.Millisecond)
-	close(this.findNodeEvent)
-	this.RT.Stop()
-
-	this.running = false
-	_ = this.udpconn.Close()
-}
-
 func (this *DHTNode) Create(ID,addrString string,
-	F func(ip string, port int, infoHash, peerID string))  {
+	F func(ip string, port int, infoHash, peerID string, verified bool))  {
+	var state *stateFile
+	if this.config.StateFile != ""{
+		var err error
+		if state,err = loadState(this.config.StateFile); err != nil && !os.IsNotExist(err){
+			this.logger.Println("loadState: ",err)
+		}
+	}
+
 	if ID == "random"{
-		this.id = generateID()
+		this.id = this.rand.id()
+		if state != nil{
+			if id,err := state.id(); err == nil{
+				this.id = id
+			}
+		}
 	}else{
 		id,err := hex.DecodeString(ID)
 		if err !=nil || len(id) != 20{
 			panic("Invalid ID.")
 		}
 		copy(this.id[:],id[:])
+		this.fixedID = true
 	}
 
 	address,err := net.ResolveUDPAddr("udp",addrString)
@@ -143,68 +169,228 @@ func (this *DHTNode) Create(ID,addrString string,
 		panic(err)
 	}
 	this.localAddress = *address
-	this.RT = NewRoutingTable(this.id,8,this)
+	this.RT = NewRoutingTable(this.id,this.config,this,this.rand)
+	this.RT6 = NewRoutingTable(this.id,this.config,this,this.rand)
+	if state != nil{
+		this.seeds = state.nodes()
+	}
 	this.PeerHandler = F
 }
 
+// maxChased bounds the nodes Join remembers having followed up.
+const maxChased = 100000
+
 func (this *DHTNode) Join(){
-	ticker := time.NewTicker(2*time.Second)
+	ctx := this.ctx
+
+	// Start from the nodes saved by the last run; the lookup falls back
+	// to the bootstrap routers if none of them answers.
+	this.pingSeeds(ctx)
+
+	// Look ourselves up first so that the nodes around us learn about us.
+	nodes,err := this.LookupNodes(ctx,this.ID())
+	if err != nil{
+		this.logger.Println("Join: ",err)
+		return
+	}
+	for _,o := range nodes{
+		this.FindNode(&o.Addr,this.rand.id())
+	}
+
+	ticker := this.config.Clock.NewTicker(2*time.Second)
 	defer ticker.Stop()
+	backupTicker := this.config.Clock.NewTicker(durationToBackup)
+	defer backupTicker.Stop()
 
+	// Nodes learned from find_node are followed up at most once per
+	// RefreshInterval, or a small network would be queried in a loop.
+	chased := make(map[string]time.Time)
 	for{
-		id := generateID()
+		id := this.rand.id()
 		select {
 		case <-this.quitEvent:
 			return
 		case o := <-this.findNodeEvent:
-			this.FindNode(&o.addr,id)
-		case <- ticker.C:
-			neighbors := this.RT.ClosestNodes(&id,8)
+			key := o.addr.String()
+			if _,ok := chased[key]; ok || len(chased) >= maxChased{
+				continue
+			}
+			chased[key] = this.config.Clock.Now()
+			this.findNode(&o.addr,this.queryID(o.id),id)
+		case <- backupTicker.Chan():
+			if err := this.saveState(); err != nil{
+				this.logger.Println("saveState: ",err)
+			}
+			now := this.config.Clock.Now()
+			for key,t := range chased{
+				if now.Sub(t) >= this.config.RefreshInterval{
+					delete(chased,key)
+				}
+			}
+		case <- ticker.Chan():
+			neighbors := this.RT.ClosestNodes(&id,this.config.K)
+			if this.udpconn6 != nil{
+				neighbors = append(neighbors,this.RT6.ClosestNodes(&id,this.config.K)...)
+			}
 
 			for _,o := range neighbors{
-				this.FindNode(&o.addr,id)
+				this.findNode(&o.addr,this.queryID(o.id),id)
 			}
 		}
 	}
 }
 
+// Serve opens the UDP sockets. A specific local address gets one socket of
+// its family; an unspecified one gets an IPv4 socket and, if the host
+// supports it, an IPv6 socket on the same port.
 func (this *DHTNode) Serve() error{
-	conn,err := net.ListenUDP("udp",&this.localAddress)
-	if err !=nil{
-		return err
+	for i := 0; i < this.config.Workers; i++{
+		this.goroutines.Add(1)
+		go this.work()
 	}
-	go func() {
-		err := this.readUDP(conn)
-		log.Println("readUDP: ",err)
 
-	}()
-	this.udpconn = conn
+	ip := this.localAddress.IP
+	if ip == nil || ip.IsUnspecified() || ip.To4() != nil{
+		addr := this.localAddress
+		if ip.To4() == nil{
+			addr.IP = net.IPv4zero
+		}
+		conn,err := this.config.Listen("udp4",&addr)
+		if err !=nil{
+			return err
+		}
+		this.udpconn = conn
+		this.goroutines.Add(1)
+		go this.serveUDP(conn)
+		if ip != nil && !ip.IsUnspecified(){
+			return nil
+		}
+	}
+
+	addr := this.localAddress
+	if ip == nil || ip.IsUnspecified(){
+		addr.IP = net.IPv6unspecified
+		if this.udpconn != nil{
+			addr.Port = this.udpconn.LocalAddr().(*net.UDPAddr).Port
+		}
+	}
+	conn,err := this.config.Listen("udp6",&addr)
+	if err != nil{
+		if this.udpconn != nil{
+			this.logger.Println("IPv6 disabled: ",err)
+			return nil
+		}
+		return err
+	}
+	this.udpconn6 = conn
+	this.goroutines.Add(1)
+	go this.serveUDP(conn)
 	return nil
 }
 
-func (this *DHTNode) Run(){
-	this.running = true
-
-	log.Println("nodeinfo = ",this.node.toString())
-	if err :=this.Serve();err !=nil{
-		log.Println("Serve udp error: ",err)
+func (this *DHTNode) serveUDP(conn PacketConn){
+	defer this.goroutines.Done()
+	err := this.readUDP(conn)
+	select {
+	case <-this.quitEvent:
+	default:
+		this.logger.Println("readUDP: ",err)
 	}
+}
 
-	go this.Join()
+// table returns the routing table for the address family of addr.
+func (this *DHTNode) table(addr *net.UDPAddr) *routingTable{
+	if addr.IP.To4() == nil{
+		return this.RT6
+	}
+	return this.RT
+}
 
-	for i := range bootstrapNodes{
-		udpAddr, err := net.ResolveUDPAddr("udp",bootstrapNodes[i])
-		if err != nil || udpAddr == nil{
-			log.Println(err)
-			continue
+// Nodes returns the entries of both routing tables.
+func (this *DHTNode) Nodes() []CompactNodeInfo{
+	var ret []CompactNodeInfo
+	for _,rt := range []*routingTable{this.RT,this.RT6}{
+		for _,bkt := range rt.Snapshot(){
+			for _,o := range bkt{
+				ret = append(ret,CompactNodeInfo{o.id,o.addr})
+			}
 		}
-		fmt.Println(udpAddr)
-		this.FindNode(udpAddr,generateID())
 	}
+	return ret
+}
 
-	log.Println("Join the DHT network...")
+// want is the "want" argument of our queries: both families when we can
+// reach both, otherwise the default of the family the query is sent on.
+func (this *DHTNode) want() []string{
+	if this.udpconn != nil && this.udpconn6 != nil{
+		return []string{"n4","n6"}
+	}
+	return nil
+}
+
+// Start opens the sockets and joins the DHT, mapping our port if a
+// PortMapper is configured. Canceling ctx shuts the node down as Shutdown
+// does.
+func (this *DHTNode) Start(ctx context.Context) error{
+	this.cancel()
+	this.ctx,this.cancel = context.WithCancel(ctx)
+	if err := this.Serve(); err != nil{
+		return err
+	}
+	this.logger.Println("nodeinfo = ",this.node.toString())
+
+	this.goroutines.Add(1)
+	go func() {
+		defer this.goroutines.Done()
+		this.Join()
+	}()
+	if this.config.PortMapper != nil && this.udpconn != nil{
+		this.goroutines.Add(1)
+		go this.mapPort(this.config.PortMapper)
+	}
+	go func() {
+		<-this.ctx.Done()
+		_ = this.Shutdown(context.Background())
+	}()
+	return nil
+}
+
+// Shutdown stops the node: queries in flight are aborted, the sockets are
+// closed, and once every packet handler has returned the routing tables are
+// saved and stopped. If ctx ends before the handlers do, ctx.Err() is
+// returned without waiting for them.
+func (this *DHTNode) Shutdown(ctx context.Context) error{
+	this.closeOnce.Do(func() {
+		close(this.quitEvent)
+		this.cancel()
+		if this.udpconn != nil{
+			_ = this.udpconn.Close()
+		}
+		if this.udpconn6 != nil{
+			_ = this.udpconn6.Close()
+		}
+		go func() {
+			this.goroutines.Wait()
+			if err := this.saveState(); err != nil{
+				this.logger.Println("saveState: ",err)
+			}
+			this.RT.Stop()
+			this.RT6.Stop()
+			close(this.done)
+		}()
+	})
+
+	select {
+	case <-this.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	this.listenConsole()
+// Done is closed once the node has shut down.
+func (this *DHTNode) Done() <-chan struct{}{
+	return this.done
 }
 
 func (this *node) toString()  string {
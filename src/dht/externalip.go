@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// minIPVotes is how many nodes must agree on an external address
+	// before we believe it.
+	minIPVotes		= 3
+	maxIPVoters		= 1024
+)
+
+// ipVoter elects our external IP from the "ip" field of responses. Every
+// responding IP has one vote, for the address it last saw us at; the most
+// common IP wins. Ports are tallied apart: behind a router that rewrites
+// ports each voter may see another one, and that must not split the vote.
+// Only the latest maxIPVoters voters count.
+type ipVoter struct {
+	mu			sync.Mutex
+	votes		map[string]*net.UDPAddr	// voter IP -> address voted for
+	voters		[]string				// voter IPs, oldest first
+	ips			map[string]int			// IP -> votes
+	ports		map[string]int			// address -> votes
+	elected		net.IP
+	mapped		*net.UDPAddr			// address opened by the PortMapper
+}
+
+func newIPVoter() *ipVoter{
+	return &ipVoter{
+		votes:		make(map[string]*net.UDPAddr),
+		ips:		make(map[string]int),
+		ports:		make(map[string]int),
+	}
+}
+
+// vote records that voter saw us at addr, and returns true if that elects
+// a new IP.
+func (this *ipVoter) vote(addr *net.UDPAddr,voter net.IP) bool{
+	v := string(voter.To16())
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if old,ok := this.votes[v]; ok{
+		if old.String() == addr.String(){
+			return false
+		}
+		this.unvote(old)
+	}else{
+		if len(this.voters) >= maxIPVoters{
+			oldest := this.voters[0]
+			this.voters = this.voters[1:]
+			this.unvote(this.votes[oldest])
+			delete(this.votes,oldest)
+		}
+		this.voters = append(this.voters,v)
+	}
+	this.votes[v] = addr
+	this.ips[string(addr.IP.To16())]++
+	this.ports[addr.String()]++
+
+	best,votes := string(this.elected.To16()),this.ips[string(this.elected.To16())]
+	for ip,n := range this.ips{
+		if n > votes{
+			best,votes = ip,n
+		}
+	}
+	if best == string(this.elected.To16()) || votes < minIPVotes{
+		return false
+	}
+	this.elected = net.IP(best)
+	return true
+}
+
+func (this *ipVoter) unvote(addr *net.UDPAddr){
+	decrement(this.ips,string(addr.IP.To16()))
+	decrement(this.ports,addr.String())
+}
+
+func decrement(counts map[string]int,key string){
+	counts[key]--
+	if counts[key] <= 0{
+		delete(counts,key)
+	}
+}
+
+// addr returns the elected IP with the port we are reachable on: the
+// mapped port if the PortMapper opened one on that IP, or else the port
+// most voters saw. Without an elected IP it returns the mapped address.
+func (this *ipVoter) addr() *net.UDPAddr{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.ips[string(this.elected.To16())] == 0{
+		return this.mapped
+	}
+	if this.mapped != nil && this.mapped.IP.Equal(this.elected){
+		return this.mapped
+	}
+	ret := &net.UDPAddr{IP: this.elected}
+	votes := 0
+	for _,v := range this.voters{
+		addr := this.votes[v]
+		if n := this.ports[addr.String()]; addr.IP.Equal(this.elected) && n > votes{
+			ret.Port,votes = addr.Port,n
+		}
+	}
+	return ret
+}
+
+func (this *ipVoter) setMapped(addr *net.UDPAddr) bool{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	changed := this.mapped == nil || this.mapped.String() != addr.String()
+	this.mapped = addr
+	return changed && this.ips[string(this.elected.To16())] == 0
+}
+
+// ExternalAddr returns the address other nodes see us at: the IP most of
+// them report in their responses, or else the one opened by the
+// PortMapper. It is nil until either is known. The port is the one to
+// announce with: the mapped one if there is one, or else the one most
+// nodes report. Behind a NAT it may differ from our local port.
+func (this *DHTNode) ExternalAddr() *net.UDPAddr{
+	addr := this.externalAddr.addr()
+	if addr == nil{
+		return nil
+	}
+	ret := *addr
+	return &ret
+}
+
+// learnExternalAddr takes note that reporter saw us at addr. Only the
+// family our ID follows is counted: IPv4 if we have an IPv4 socket.
+func (this *DHTNode) learnExternalAddr(addr *net.UDPAddr,reporter *net.UDPAddr){
+	if (addr.IP.To4() != nil) != (this.udpconn != nil) || isLocalIP(addr.IP){
+		return
+	}
+	if !this.externalAddr.vote(addr,reporter.IP){
+		return
+	}
+	this.logger.Println("external IP: ",addr.IP)
+	this.adoptExternalIP(addr.IP)
+}
@@ -0,0 +1,103 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func testAddr(s string) *net.UDPAddr{
+	addr,err := net.ResolveUDPAddr("udp",s)
+	if err != nil{
+		panic(err)
+	}
+	return addr
+}
+
+func voterIP(i int) net.IP{
+	return net.IPv4(10,0,byte(i >> 8),byte(i))
+}
+
+// A router rewriting ports shows each voter another port; the IP must
+// still win the election.
+func TestIPVoterSplitPorts(t *testing.T){
+	v := newIPVoter()
+	for i := 0; i < minIPVotes - 1; i++{
+		if v.vote(&net.UDPAddr{IP: net.IPv4(198,51,100,1),Port: 40000 + i},voterIP(i)){
+			t.Fatalf("elected after %d votes",i + 1)
+		}
+	}
+	if v.addr() != nil{
+		t.Errorf("addr() = %v before an election",v.addr())
+	}
+	if !v.vote(testAddr("198.51.100.1:40000"),voterIP(minIPVotes)){
+		t.Fatal("no IP elected")
+	}
+	// 40000 now has two votes, the other ports one each.
+	if addr := v.addr(); addr.String() != "198.51.100.1:40000"{
+		t.Errorf("addr() = %v, want 198.51.100.1:40000",addr)
+	}
+}
+
+func TestIPVoterChange(t *testing.T){
+	v := newIPVoter()
+	for i := 0; i < 3; i++{
+		v.vote(testAddr("198.51.100.1:6881"),voterIP(i))
+	}
+	// Voters changing their minds move the election; a repeated vote
+	// counts once.
+	for i := 0; i < 3; i++{
+		v.vote(testAddr("203.0.113.9:6881"),voterIP(i))
+		v.vote(testAddr("203.0.113.9:6881"),voterIP(i))
+	}
+	if elected := v.vote(testAddr("203.0.113.9:6881"),voterIP(3)); elected{
+		t.Error("re-elected the same IP")
+	}
+	if addr := v.addr(); addr.String() != "203.0.113.9:6881"{
+		t.Errorf("addr() = %v, want 203.0.113.9:6881",addr)
+	}
+	if n := v.ips[string(net.ParseIP("198.51.100.1").To16())]; n != 0{
+		t.Errorf("old IP keeps %d votes",n)
+	}
+}
+
+func TestIPVoterOldest(t *testing.T){
+	v := newIPVoter()
+	for i := 0; i < maxIPVoters; i++{
+		v.vote(testAddr("198.51.100.1:6881"),voterIP(i))
+	}
+	for i := 0; i < maxIPVoters; i++{
+		v.vote(testAddr("203.0.113.9:6881"),voterIP(maxIPVoters + i))
+	}
+	if len(v.voters) != maxIPVoters || len(v.votes) != maxIPVoters{
+		t.Errorf("%d voters and %d votes, want %d",len(v.voters),len(v.votes),maxIPVoters)
+	}
+	if addr := v.addr(); addr.String() != "203.0.113.9:6881"{
+		t.Errorf("addr() = %v, want 203.0.113.9:6881",addr)
+	}
+}
+
+func TestIPVoterMapped(t *testing.T){
+	v := newIPVoter()
+	if !v.setMapped(testAddr("198.51.100.1:7000")){
+		t.Error("new mapping not reported")
+	}
+	if v.setMapped(testAddr("198.51.100.1:7000")){
+		t.Error("same mapping reported twice")
+	}
+	if addr := v.addr(); addr.String() != "198.51.100.1:7000"{
+		t.Errorf("addr() = %v before an election, want the mapped one",addr)
+	}
+
+	for i := 0; i < 3; i++{
+		v.vote(testAddr("198.51.100.1:6881"),voterIP(i))
+	}
+	// The mapped port beats the one the voters saw on the same IP...
+	if addr := v.addr(); addr.String() != "198.51.100.1:7000"{
+		t.Errorf("addr() = %v, want 198.51.100.1:7000",addr)
+	}
+	// ...but not a mapping on another IP, such as behind a second NAT.
+	v.setMapped(testAddr("100.64.0.5:7000"))
+	if addr := v.addr(); addr.String() != "198.51.100.1:6881"{
+		t.Errorf("addr() = %v, want 198.51.100.1:6881",addr)
+	}
+}
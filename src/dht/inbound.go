@@ -0,0 +1,175 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sourceExpiry		= 1 * time.Minute	// idle sources are forgotten after this
+	sourceSweepInterval	= 1 * time.Minute
+	maxSources			= 100000			// beyond this new sources are not rate limited
+)
+
+// InboundStats counts what happened to the packets we received.
+type InboundStats struct {
+	Accepted	int64	// queued for a worker
+	Blocked		int64	// from an address on the blocklist
+	Banned		int64	// from a banned address
+	RateLimited	int64	// over the per-IP rate
+	QueueFull	int64	// no worker was free
+	Malformed	int64	// not valid bencode
+}
+
+type packet struct {
+	address		*net.UDPAddr
+	data		[]byte
+}
+
+// source is what the inbound guard knows about one IP.
+type source struct {
+	bucket		*tokenBucket	// nil if unlimited
+	strikes		int				// malformed packets since the last ban
+	bannedUntil	time.Time
+	last		time.Time
+}
+
+// inboundGuard decides which received packets are handled at all.
+type inboundGuard struct {
+	config		*Config
+	blocklist	atomic.Pointer[Blocklist]
+
+	mu			sync.Mutex
+	sources		map[string]*source
+	swept		time.Time
+	stats		InboundStats
+}
+
+func newInboundGuard(config *Config) *inboundGuard{
+	ret := &inboundGuard{
+		config:		config,
+		sources:	make(map[string]*source),
+		swept:		config.Clock.Now(),
+	}
+	ret.blocklist.Store(config.Blocklist)
+	return ret
+}
+
+func (this *inboundGuard) blocked(ip net.IP) bool{
+	return this.blocklist.Load().Contains(ip)
+}
+
+// admit reports whether a packet from ip may be handled.
+func (this *inboundGuard) admit(ip net.IP) bool{
+	if this.blocked(ip){
+		this.count(&this.stats.Blocked)
+		return false
+	}
+
+	now := this.config.Clock.Now()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if now.Sub(this.swept) >= sourceSweepInterval{
+		this.sweep(now)
+	}
+	s := this.source(ip,now)
+	if s == nil{
+		this.stats.Accepted++
+		return true
+	}
+	s.last = now
+	if now.Before(s.bannedUntil){
+		this.stats.Banned++
+		return false
+	}
+	if s.bucket != nil && !s.bucket.allow(now){
+		this.stats.RateLimited++
+		return false
+	}
+	this.stats.Accepted++
+	return true
+}
+
+// strike records a malformed packet from ip and bans ip once it has sent
+// BanThreshold of them.
+func (this *inboundGuard) strike(ip net.IP){
+	now := this.config.Clock.Now()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.stats.Malformed++
+	s := this.source(ip,now)
+	if s == nil{
+		return
+	}
+	s.strikes++
+	if s.strikes >= this.config.BanThreshold{
+		s.strikes = 0
+		s.bannedUntil = now.Add(this.config.BanDuration)
+	}
+}
+
+// source returns the entry of ip, creating it if there is room.
+func (this *inboundGuard) source(ip net.IP,now time.Time) *source{
+	key := string(ip.To16())
+	s,ok := this.sources[key]
+	if ok{
+		return s
+	}
+	if len(this.sources) >= maxSources{
+		return nil
+	}
+	s = &source{last: now}
+	if this.config.MaxPacketsPerIP > 0{
+		s.bucket = newTokenBucket(this.config.MaxPacketsPerIP,now)
+	}
+	this.sources[key] = s
+	return s
+}
+
+// sweep forgets idle sources that are not banned.
+func (this *inboundGuard) sweep(now time.Time){
+	for key,s := range this.sources{
+		if now.Sub(s.last) >= sourceExpiry && now.After(s.bannedUntil){
+			delete(this.sources,key)
+		}
+	}
+	this.swept = now
+}
+
+func (this *inboundGuard) count(n *int64){
+	this.mu.Lock()
+	*n++
+	this.mu.Unlock()
+}
+
+func (this *inboundGuard) snapshot() InboundStats{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.stats
+}
+
+// InboundStats returns the counters of received packets.
+func (this *DHTNode) InboundStats() InboundStats{
+	return this.guard.snapshot()
+}
+
+// SetBlocklist replaces the blocklist applied to received packets and to
+// announced peers. nil blocks nothing.
+func (this *DHTNode) SetBlocklist(b *Blocklist){
+	this.guard.blocklist.Store(b)
+}
+
+// work handles received packets until the node shuts down.
+func (this *DHTNode) work(){
+	defer this.goroutines.Done()
+	for{
+		select {
+		case p := <-this.packets:
+			this.handleKRPCPacket(p.address,p.data)
+		case <-this.quitEvent:
+			return
+		}
+	}
+}
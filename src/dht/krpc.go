@@ -1,18 +1,42 @@
 package dht
 
 import (
+	"bencode"
+	"context"
 	"encoding/hex"
 	"errors"
-	"log"
 	"net"
 	"time"
 )
 
-func (this *DHTNode) writeToUDP(addr *net.UDPAddr,data []byte) error{
-	this.udpconn.SetWriteDeadline(time.Now().Add(5*time.Second))
-	n,err := this.udpconn.WriteToUDP(data,addr)
+// writeToUDP sends data once the rate limiter lets a packet of kind through.
+// Only queries wait for the limiter; replies over the budget are dropped.
+func (this *DHTNode) writeToUDP(addr *net.UDPAddr,data []byte,kind string) error{
+	delay,err := this.limiter.reserve(kind)
 	if err != nil{
-		log.Println("writeToUDP: ",err)
+		return err
+	}
+	if delay > 0{
+		wait,timer := after(this.config.Clock,delay)
+		select {
+		case <-wait:
+		case <-this.quitEvent:
+			timer.Stop()
+			return net.ErrClosed
+		}
+	}
+
+	conn := this.udpconn
+	if addr.IP.To4() == nil{
+		conn = this.udpconn6
+	}
+	if conn == nil{
+		return errors.New("writeToUDP: no socket for address family.")
+	}
+	conn.SetWriteDeadline(time.Now().Add(this.config.WriteTimeout))
+	n,err := conn.WriteToUDP(data,addr)
+	if err != nil{
+		this.logger.Println("writeToUDP: ",err)
 		return err
 	}
 	if n != len(data){
@@ -21,134 +45,228 @@ func (this *DHTNode) writeToUDP(addr *net.UDPAddr,data []byte) error{
 	return nil
 }
 
-func (this *DHTNode) readUDP(conn *net.UDPConn) error{
-	msg := make([]byte,8192)
+func (this *DHTNode) readUDP(conn PacketConn) error{
+	msg := make([]byte,this.config.ReadBufferSize)
 	for{
 		n,address,err := conn.ReadFromUDP(msg)
-		//log.Println("get address = : ",address)
+		//this.logger.Println("get address = : ",address)
 		if err != nil{
 			return err
 		}
 
+		if !this.guard.admit(address.IP){
+			continue
+		}
+
 		buf := make([]byte,n)
 		copy(buf,msg)
 		if len(buf) != n{
 			panic("copy error")
 		}
-		go this.handleKRPCPacket(address,buf)
-
+		select {
+		case this.packets <- packet{address,buf}:
+		default:
+			this.guard.count(&this.guard.stats.QueueFull)
+		}
 	}
 }
 
 /*Query handlers*/
 func (this *DHTNode) handlePing(query *KRPCQuery,address *net.UDPAddr){
 	response := KRPCResponse{
-		transactionID: 	GenerateToken(),
+		transactionID: 	query.transactionID,
 		Type:			PingType,
-		queryID:        this.id,
+		queryID:        this.responseID(PingType,query.id),
+		ip:			address,
 	}
 
 	data,err := response.Encode()
 	if err != nil{
-		log.Println("Handling ping: ",err)
+		this.logger.Println("Handling ping: ",err)
 	}
-	_ = this.writeToUDP(address,data)
+	_ = this.writeToUDP(address,data,ResponseKind)
 }
 
 func (this *DHTNode) handleFindNode(query *KRPCQuery,address *net.UDPAddr){
 	response := KRPCResponse{
 		transactionID: 	query.transactionID,
 		Type: 			FindNodeType,
-		queryID: 		this.id,
-		nodes: 			make([]*node,0),
+		queryID: 		this.responseID(FindNodeType,query.queryingID),
+		ip:			address,
 	}
+	response.nodes,response.nodes6 = this.closestNodes(query,address,query.queryingID)
 	data,err := response.Encode()
 	if err != nil{
-		log.Println("Handling FindNode: ",err)
+		this.logger.Println("Handling FindNode: ",err)
 	}
-	_ = this.writeToUDP(address,data)
+	_ = this.writeToUDP(address,data,ResponseKind)
 }
 
 func (this *DHTNode) handleGetPeers(query *KRPCQuery,address *net.UDPAddr){
-	tempID := generateID()
+	var infohash IDType
+	copy(infohash[:],query.infoHash)
 	response := KRPCResponse{
 		transactionID: 	query.transactionID,
 		Type: 			GetPeersType,
-		queryID:		tempID,
-		token:			string(query.infoHash[:2]),
-		nodes:			make([]*node,0),
+		queryID:		this.responseID(GetPeersType,infohash),
+		ip:			address,
+		token:			this.tokens.generate(address.IP),
+		values:			this.Peers.values(infohash),
 	}
+	response.nodes,response.nodes6 = this.closestNodes(query,address,infohash)
 	data,err := response.Encode()
 	if err != nil{
-		log.Println("Handling FindNode: ",err)
+		this.logger.Println("Handling GetPeers: ",err)
 	}
-	_ = this.writeToUDP(address,data)
+	_ = this.writeToUDP(address,data,ResponseKind)
 }
 
+// handleAnounce stores the announced peer if its token is valid. Announces
+// with a bad token are answered with an error but still passed to
+// PeerHandler, marked as unverified.
 func (this *DHTNode) handleAnounce(query *KRPCQuery,address *net.UDPAddr){
 	port := query.port
 	if query.impliedPort == 1{
 		port = address.Port
 	}
 
+	var infohash IDType
+	copy(infohash[:],query.infoHash)
+	if this.guard.blocked(address.IP){
+		return
+	}
+	verified := this.tokens.validate(address.IP,query.token)
+	if verified{
+		this.Peers.Add(infohash,&net.TCPAddr{IP: address.IP,Port: port})
+	}
+
 	this.PeerHandler(address.IP.String(),port,
 		hex.EncodeToString(query.infoHash),
 		hex.EncodeToString(query.queryingID[:]),
+		verified,
 	)
 
+	if !verified{
+		this.replyError(query.transactionID,address,KRPCErrBadToken)
+		return
+	}
+
 	response := KRPCResponse{
 		transactionID: 	query.transactionID,
 		Type: 			AnnoucePeerType,
-		queryID:		this.id,
+		queryID:		this.responseID(AnnoucePeerType,infohash),
+		ip:			address,
 	}
 	data,err := response.Encode()
 	if err != nil{
-		log.Println("Handling ping: ",err)
+		this.logger.Println("Handling ping: ",err)
 	}
-	_ = this.writeToUDP(address,data)
+	_ = this.writeToUDP(address,data,ResponseKind)
 }
 
-/*Functions to make requests*/
-func (this *DHTNode) Ping(addr *net.UDPAddr) error{
-	request := KRPCQuery{
-		transactionID: 	GenerateToken(),
-		Type:			PingType,
-		id:				this.id,
+// closestNodes returns the nodes closest to target for a find_node or
+// get_peers response: IPv4 nodes for "nodes" and IPv6 nodes for "nodes6".
+// Without a "want" argument only the family of the querying node is sent.
+func (this *DHTNode) closestNodes(query *KRPCQuery,address *net.UDPAddr,target IDType) ([]*node,[]*node){
+	n4,n6 := address.IP.To4() != nil,address.IP.To4() == nil
+	if len(query.want) > 0{
+		n4,n6 = false,false
+		for _,w := range query.want{
+			n4 = n4 || w == "n4"
+			n6 = n6 || w == "n6"
+		}
 	}
 
-	data,err := request.Encode()
-	if err != nil{
-		return err
+	var nodes,nodes6 []*node
+	if n4{
+		nodes = closestIn(this.RT,target,this.config.K)
+	}
+	if n6{
+		nodes6 = closestIn(this.RT6,target,this.config.K)
 	}
-	return this.writeToUDP(addr,data)
+	return nodes,nodes6
 }
 
-func (this *DHTNode) FindNode(address *net.UDPAddr, targetID IDType) {
-	request := KRPCQuery{
-		transactionID: 	GenerateToken(),
-		Type: 			FindNodeType,
-		id:				this.id,
-		queryingID:		targetID,
+func closestIn(rt *routingTable,target IDType,n int) []*node{
+	closest := rt.ClosestNodes(&target,n)
+	ret := make([]*node,len(closest))
+	for i := range closest{
+		ret[i] = &closest[i]
 	}
+	return ret
+}
 
-	msg,err := request.Encode()
+// replyError answers the query with transaction ID t with a KRPC error.
+func (this *DHTNode) replyError(t []byte,address *net.UDPAddr,krpcErr *ErrorType){
+	data,err := bencode.Marshal(&KRPCMessage{
+		T:	string(t),
+		Y:	"e",
+		E:	krpcErr,
+	})
 	if err != nil{
-		log.Println(err)
+		this.logger.Println("Replying error: ",err)
+		return
 	}
-	_ = this.writeToUDP(address,msg)
+	_ = this.writeToUDP(address,data,ResponseKind)
 }
 
-func (this *DHTNode) GetPeers(address *net.UDPAddr, infohash []byte) {
-	tempid := generateID()
-	request := KRPCQuery{
-		transactionID:		GenerateToken(),
-		id:					this.id,
-		infoHash:   		tempid[:],
-	}
+/*Functions to make requests*/
 
-	msg,err := request.Encode()
-	if err != nil{
-		log.Println(err)
+// Ping reports whether the node at addr answers a ping.
+func (this *DHTNode) Ping(addr *net.UDPAddr) error{
+	_,err := this.Query(this.ctx,addr,&KRPCQuery{
+		Type:	PingType,
+	})
+	return err
+}
+
+// Refresh looks up target so that the routing table learns the nodes
+// around it.
+func (this *DHTNode) Refresh(target IDType){
+	if _,err := this.LookupNodes(this.ctx,target); err != nil{
+		this.logger.Println("Refresh: ",err)
 	}
-	_ = this.writeToUDP(address,msg)
-}
\ No newline at end of file
+}
+
+// FindNode asks the node at address for the nodes closest to targetID and
+// passes them on to Join.
+func (this *DHTNode) FindNode(address *net.UDPAddr, targetID IDType) {
+	this.findNode(address,this.queryID(targetID),targetID)
+}
+
+// findNode is FindNode sent with the ID from.
+func (this *DHTNode) findNode(address *net.UDPAddr,from,targetID IDType){
+	this.goroutines.Add(1)
+	go func() {
+		defer this.goroutines.Done()
+		R,err := this.Query(this.ctx,address,&KRPCQuery{
+			Type:		FindNodeType,
+			id:			from,
+			queryingID:	targetID,
+			want:		this.want(),
+		})
+		if err != nil{
+			if this.ctx.Err() == nil && err != ErrRateLimited{
+				this.logger.Println("FindNode: ",err)
+			}
+			return
+		}
+		for _,o := range append(R.nodes,R.nodes6...){
+			select {
+			case this.findNodeEvent <- o:
+			case <-this.quitEvent:
+				return
+			}
+		}
+	}()
+}
+
+// GetPeers asks the node at address for peers of infohash. The response
+// holds either peers or the closest nodes, and a token for announcing.
+func (this *DHTNode) GetPeers(ctx context.Context,address *net.UDPAddr, infohash []byte) (*KRPCResponse,error){
+	return this.Query(ctx,address,&KRPCQuery{
+		Type:		GetPeersType,
+		infoHash:	infohash,
+		want:		this.want(),
+	})
+}
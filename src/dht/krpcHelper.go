@@ -2,7 +2,6 @@ package dht
 
 import (
 	"bencode"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -20,43 +19,117 @@ type node struct {
 	addr 				net.UDPAddr
 }
 
+// KRPCMessage is the bencoded dictionary every KRPC packet consists of.
 type KRPCMessage struct {
-	t string
-	y string
-	content map[string]interface{}
+	T string          `bencode:"t"`
+	Y string          `bencode:"y"`
+	Q string          `bencode:"q,omitempty"`
+	A *queryArguments `bencode:"a,omitempty"`
+	R *responseValues `bencode:"r,omitempty"`
+	E *ErrorType      `bencode:"e,omitempty"`
+	IP []byte         `bencode:"ip,omitempty"` // compact address of the querying node, BEP 42
+
+	// RawA and RawR hold the "a" and "r" dictionaries of a received message
+	// exactly as they arrived, for logging and forwarding.
+	RawA bencode.RawMessage `bencode:"-"`
+	RawR bencode.RawMessage `bencode:"-"`
 }
 
+// krpcEnvelope is a KRPCMessage with "a" and "r" left undecoded.
+type krpcEnvelope struct {
+	T string             `bencode:"t"`
+	Y string             `bencode:"y"`
+	Q string             `bencode:"q"`
+	A bencode.RawMessage `bencode:"a"`
+	R bencode.RawMessage `bencode:"r"`
+	E *ErrorType         `bencode:"e"`
+	IP []byte            `bencode:"ip"`
+}
+
+// queryArguments is the "a" dictionary of a query.
+type queryArguments struct {
+	ID          IDType `bencode:"id"`
+	Target      []byte `bencode:"target,omitempty"`
+	InfoHash    []byte `bencode:"info_hash,omitempty"`
+	ImpliedPort int8   `bencode:"implied_port,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+	Want        []string `bencode:"want,omitempty"`
+}
+
+// responseValues is the "r" dictionary of a response.
+type responseValues struct {
+	ID     IDType   `bencode:"id"`
+	Token  string   `bencode:"token,omitempty"`
+	Nodes  []byte   `bencode:"nodes,omitempty"`
+	Nodes6 []byte   `bencode:"nodes6,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+}
+
+// maxPacketSize is the default largest KRPC packet we read.
+const maxPacketSize = 8192
+
+// decoderOptions bounds what a single packet from the network may make the
+// decoder do. Nothing in a packet is longer than the packets we read.
+func decoderOptions(config *Config) bencode.DecoderOptions{
+	return bencode.DecoderOptions{
+		MaxDepth:			8,
+		MaxStringLength:	int64(config.ReadBufferSize),
+		MaxItems:			1024,
+		MaxSize:			int64(config.ReadBufferSize),
+	}
+}
 
-func decodeMessage(data []byte)(*KRPCMessage,error){
+// decodeMessage decodes a packet with opts. If the packet is well-formed
+// bencode but some fields have the wrong type, it returns what it could
+// decode together with the error, so that a query can still be answered
+// with an error.
+func decodeMessage(data []byte,opts bencode.DecoderOptions)(*KRPCMessage,error){
 	// decode a message from bencode form.
-	temp, err := bencode.Unmarshal(data)
-	if err != nil{
+	var envelope krpcEnvelope
+	err := opts.Unmarshal(data,&envelope)
+	if _,ok := err.(*bencode.UnmarshalTypeError); err != nil && !ok{
 		return nil,err
 	}
 
-	msg := new(KRPCMessage)
-	content := temp.(map[string]interface{})
-	if t,ok := content["t"].([]byte); ok {
-		msg.t = string(t)
+	msg := &KRPCMessage{
+		T:		envelope.T,
+		Y:		envelope.Y,
+		Q:		envelope.Q,
+		E:		envelope.E,
+		IP:		envelope.IP,
+		RawA:	envelope.A,
+		RawR:	envelope.R,
+	}
+	if err != nil{
+		return msg,err
+	}
+	if len(msg.RawA) > 0{
+		msg.A = new(queryArguments)
+		if err := opts.Unmarshal(msg.RawA,msg.A); err != nil{
+			return msg,err
+		}
 	}
-	if y,ok := content["y"].([]byte); ok{
-		msg.y = string(y)
+	if len(msg.RawR) > 0{
+		msg.R = new(responseValues)
+		if err := opts.Unmarshal(msg.RawR,msg.R); err != nil{
+			return msg,err
+		}
 	}
-	msg.content = content  // why?
-	return msg,err
+	return msg,nil
 }
 
 func (this *KRPCMessage) isQuery() bool {
-	return this.y == "q"
+	return this.Y == "q"
 }
 
 
 func (this *KRPCMessage) isResponse() bool {
-	return this.y == "r"
+	return this.Y == "r"
 }
 
 func (this *KRPCMessage) isError() bool {
-	return this.y == "e"
+	return this.Y == "e"
 }
 
 type KRPCResponse struct {
@@ -65,61 +138,66 @@ type KRPCResponse struct {
 	queryID 		IDType
 	token 			string
 	nodes 			[]*node
-	values			[]string
+	nodes6			[]*node
+	values			[]CompactPeerInfo
+	ip				*net.UDPAddr	// the querying node as the responder sees it, BEP 42
 }
 
 
-func (this *KRPCResponse) LoadFromMap(data map[string]interface{}) error{
-	this.transactionID = data["t"].([]byte)
-	data = data["r"].(map[string]interface{})
-	if queryID,ok := data["token"]; ok {
-		copy(this.queryID[:],queryID.([]byte))
+func (this *KRPCResponse) LoadFromMessage(msg *KRPCMessage) error{
+	if msg.R == nil{
+		return errors.New("Missing return values.")
 	}
-	if token,ok := data["token"]; ok{
-		this.token = string(token.([]byte))
+	this.transactionID = []byte(msg.T)
+	this.queryID = msg.R.ID
+	this.token = msg.R.Token
+	if len(msg.R.Nodes) > 0{
+		this.nodes = decodeCompactNodes(msg.R.Nodes,net.IPv4len)
 	}
-	if nodes,ok := data["nodes"]; ok{
-		this.nodes = decodeCompactNodes(nodes.([]byte))
+	if len(msg.R.Nodes6) > 0{
+		this.nodes6 = decodeCompactNodes(msg.R.Nodes6,net.IPv6len)
 	}
-	if values,ok := data["values"]; ok{
-		vector := values.([]interface{})
-		for _,value := range  vector{
-			this.values = append(this.values,string(value.([]byte)))
+	for _,v := range msg.R.Values{
+		if peer,err := DecodeCompactPeerInfo([]byte(v)); err == nil{
+			this.values = append(this.values,peer)
 		}
 	}
+	if peer,err := DecodeCompactPeerInfo(msg.IP); err == nil{
+		this.ip = &net.UDPAddr{IP: peer.IP,Port: peer.Port}
+	}
 	return nil
 }
 
 func (this *KRPCResponse) Encode() ([]byte,error){
-	data := map[string]interface{}{
-		"t" : this.transactionID,
-		"y" : []byte("r"),
+	r := &responseValues{
+		ID : this.queryID,
 	}
 
 	switch this.Type {
 	case PingType:
-		data["r"] = map[string]interface{}{
-			"id" : this.queryID[:],
-		}
 	case FindNodeType:
-		data["r"] = map[string]interface{}{
-			"id" : this.queryID[:],
-			"nodes" : encodeCompactForm(this.nodes),
-		}
+		r.Nodes = encodeCompactForm(this.nodes,net.IPv4len)
+		r.Nodes6 = encodeCompactForm(this.nodes6,net.IPv6len)
 	case GetPeersType:
-		data["r"] = map[string]interface{}{
-			"id" : this.queryID[:],
-			"token" : this.token,
-			"nodes" : encodeCompactForm(this.nodes),
+		r.Token = this.token
+		r.Nodes = encodeCompactForm(this.nodes,net.IPv4len)
+		r.Nodes6 = encodeCompactForm(this.nodes6,net.IPv6len)
+		for _,peer := range this.values{
+			r.Values = append(r.Values,string(peer.Encode()))
 		}
 	case AnnoucePeerType:
-		data["r"] = map[string]interface{}{
-			"id" : this.queryID[:],
-		}
 	default:
 		return nil,errors.New("Unkown type.")
 	}
-	return bencode.Marshal(data)
+	msg := &KRPCMessage{
+		T : string(this.transactionID),
+		Y : "r",
+		R : r,
+	}
+	if this.ip != nil{
+		msg.IP = CompactPeerInfo{this.ip.IP,this.ip.Port}.Encode()
+	}
+	return bencode.Marshal(msg)
 }
 
 type KRPCQuery struct {
@@ -132,145 +210,132 @@ type KRPCQuery struct {
 	impliedPort    		int8
 	port				int
 	token   			string
+	want				[]string	// "n4" and/or "n6", BEP 32
 }
 
-func (this *KRPCQuery) LoadFormMap(data map[string]interface{}) error{
-	if t, ok := data["t"]; ok {
-		this.transactionID = t.([]byte)
-	}
-	if qtype, ok := data["q"]; ok{
-		this.Type = string(qtype.([]byte))
-	}
-
-	data = data["a"].(map[string]interface{})
-
-	if nodeID, ok := data["id"]; ok{
-		copy(this.id[:],nodeID.([]byte))
+// LoadFromMessage fills the query from msg and checks the arguments the
+// method needs. Errors are *ErrorType values ready to be sent back.
+func (this *KRPCQuery) LoadFromMessage(msg *KRPCMessage) error{
+	// set first, so that an error can be sent back under the query's ID
+	this.transactionID = []byte(msg.T)
+	this.Type = msg.Q
+	if msg.A == nil{
+		return KRPCErrMalformedPacket
 	}
+	this.id = msg.A.ID
+	copy(this.queryingID[:],msg.A.Target)
+	this.infoHash = msg.A.InfoHash
+	this.impliedPort = msg.A.ImpliedPort
+	this.port = msg.A.Port
+	this.token = msg.A.Token
+	this.want = msg.A.Want
 
-	if target, ok := data["target"]; ok{
-		copy(this.queryingID[:],target.([]byte))
-	}
-	if info, ok := data["infohash"]; ok {
-		this.infoHash = info.([]byte)
-	}
-	if impliedPort, ok := data["implied_port"]; ok {
-		this.impliedPort = int8(impliedPort.(int64))
-	}
-
-	if port, ok := data["port"]; ok {
-		this.port = int(port.(int64))
-	}
-
-	if token, ok := data["token"]; ok {
-		this.token =  string(token.([]byte))
+	switch this.Type {
+	case PingType:
+	case FindNodeType:
+		if len(msg.A.Target) != len(this.queryingID){
+			return KRPCErrInvalidArguments
+		}
+	case GetPeersType:
+		if len(this.infoHash) != len(IDType{}){
+			return KRPCErrInvalidArguments
+		}
+	case AnnoucePeerType:
+		if len(this.infoHash) != len(IDType{}){
+			return KRPCErrInvalidArguments
+		}
+		if this.impliedPort == 0 && (this.port <= 0 || this.port > 65535){
+			return KRPCErrInvalidArguments
+		}
+		if this.token == ""{
+			return KRPCErrBadToken
+		}
+	default:
+		return KRPCErrMethodUnknown
 	}
 	return nil
 }
 
 func (this *KRPCQuery) Encode()([]byte,error){
-	data := map[string]interface{}{
-		"t" : this.transactionID,
-		"q" : []byte(this.Type),
-		"y" : []byte("q"),
+	a := &queryArguments{
+		ID : this.id,
 	}
 	switch this.Type {
 	case PingType:
-		data["a"] = map[string]interface{}{
-			"id" : this.id[:],
-		}
 	case FindNodeType:
-		data["a"] = map[string]interface{}{
-			"id" : this.id[:],
-			"target" : this.queryingID[:],
-		}
+		a.Target = this.queryingID[:]
+		a.Want = this.want
 	case GetPeersType:
-		data["a"] = map[string]interface{}{
-			"id" : this.id[:],
-			"infohash" : this.infoHash,
-		}
+		a.InfoHash = this.infoHash
+		a.Want = this.want
 	case AnnoucePeerType:
-		data["a"] = map[string]interface{}{
-			"id" : this.id[:],
-			"implied_port" : this.impliedPort,
-			"infohash" : this.infoHash,
-			"port" : this.port,
-			"token" : this.token,
-		}
+		a.ImpliedPort = this.impliedPort
+		a.InfoHash = this.infoHash
+		a.Port = this.port
+		a.Token = this.token
 	default:
 		return nil,errors.New("Unknown type.")
 	}
-	return bencode.Marshal(data)
+	return bencode.Marshal(&KRPCMessage{
+		T : string(this.transactionID),
+		Y : "q",
+		Q : this.Type,
+		A : a,
+	})
 }
 
 const (
 	keySize = 160
-	compactNodeSize = 26
 )
 
-func encodeCompactForm (nodes []*node)[]byte{
-	data := make([]byte,0,compactNodeSize * len(nodes))
-	ipbuf := make([]byte,4)
-	portbuf := make([]byte,2)
-	for _,node := range nodes{
-		if len(node.addr.IP) == net.IPv4len{
-			ipbuf = []byte(node.addr.IP)
-		}else if len(node.addr.IP) == net.IPv6len{
-			ipbuf = []byte(node.addr.IP[12:16])
-		}else{
-			continue
-		}
-		binary.LittleEndian.PutUint16(portbuf,uint16(node.addr.Port))
-		data = append(data,node.id[:]...)
-		data = append(data,ipbuf...)
-		data = append(data,portbuf...)
-	}
-	return data
-}
-
-func decodeCompactNodes(data []byte) []*node {
-	l := len(data)
-	if l % compactNodeSize != 0{
-		return nil
-	}
-
-	ret := make([]*node,0,l/compactNodeSize)
-	for i:=0;i<l; i+= compactNodeSize{
-		var id IDType
-		copy(id[:],data[i:i+20])
-		o := &node{
-			id : id,
-			addr : net.UDPAddr{
-				IP : net.IPv4(data[i+20],data[i+21],data[i+22],data[i+23]),
-				Port : int(binary.LittleEndian.Uint16(data[i+24:i+26])),
-			},
-		}
-		ret = append(ret, o)
-	}
-	return ret
-}
-
 /*ErrorType*/
 
+// Error codes from BEP 5. Malformed packets, invalid arguments and bad tokens
+// are all protocol errors and differ only in their message.
 var(
 	KRPCErrGeneric = newError(201, "A Generic Error Ocurred")
-	KRPCErrServer = newError(201, "A Server Error Ocurred")
-	KPRCErrProtocol = newError(203, "A Protocol Error Ocurred")
-	KPRCErrMalformedPacket = newError(203, "A Protocol Error Ocurred")
+	KRPCErrServer = newError(202, "A Server Error Ocurred")
+	KRPCErrProtocol = newError(203, "A Protocol Error Ocurred")
+	KRPCErrMalformedPacket = newError(203, "Malformed Packet")
+	KRPCErrInvalidArguments = newError(203, "Invalid Arguments")
+	KRPCErrBadToken = newError(203, "Bad Token")
 	KRPCErrMethodUnknown = newError(204, "Method Unknown")
 )
 
+// ErrorType is a KRPC error, sent on the wire as the list [Code, Message].
 type ErrorType struct {
-	code	int
-	msg		string
+	Code	int
+	Message	string
 }
 
 func (err *ErrorType) Error() string{
-	return err.msg
+	return fmt.Sprintf("Error<%d>: %s",err.Code,err.Message)
+}
+
+func (err *ErrorType) MarshalBencode() ([]byte,error){
+	return bencode.Marshal([]interface{}{err.Code,err.Message})
+}
+
+func (err *ErrorType) UnmarshalBencode(data []byte) error{
+	var list []interface{}
+	if e := bencode.Unmarshal(data,&list); e != nil{
+		return e
+	}
+	if len(list) != 2{
+		return errors.New("Invalid error list.")
+	}
+	code,ok := list[0].(int64)
+	msg,ok2 := list[1].([]byte)
+	if !ok || !ok2{
+		return errors.New("Invalid error list.")
+	}
+	err.Code = int(code)
+	err.Message = string(msg)
+	return nil
 }
 
-func newError(code int,str string) error{
-	return &ErrorType{code,fmt.Sprintf("Error<%d>: %s",code,str)}
+func newError(code int,str string) *ErrorType{
+	return &ErrorType{code,str}
 }
 
 /*Other Functions*/
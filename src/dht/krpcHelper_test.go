@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"testing"
+)
+
+// A query that fails to load still carries its transaction ID, so that the
+// error can be matched by the querier.
+func TestQueryErrorTransactionID(t *testing.T){
+	for _,c := range []struct {
+		raw		string
+		err		*ErrorType
+	}{
+		{"d1:q4:ping1:t2:aa1:y1:qe",KRPCErrMalformedPacket},
+		{"d1:ad2:id20:abcdefghij0123456789e1:q9:find_node1:t2:aa1:y1:qe",KRPCErrInvalidArguments},
+		{"d1:ad2:id20:abcdefghij0123456789e1:q4:vote1:t2:aa1:y1:qe",KRPCErrMethodUnknown},
+	}{
+		msg,err := decodeMessage([]byte(c.raw),decoderOptions(DefaultConfig()))
+		if err != nil{
+			t.Fatal(err)
+		}
+		Q := new(KRPCQuery)
+		if err := Q.LoadFromMessage(msg); err != c.err{
+			t.Errorf("%q: got error %v, want %v",c.raw,err,c.err)
+		}
+		if string(Q.transactionID) != "aa"{
+			t.Errorf("%q: transaction ID %q, want \"aa\"",c.raw,Q.transactionID)
+		}
+	}
+}
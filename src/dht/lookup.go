@@ -0,0 +1,207 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"sort"
+)
+
+type lookupCandidate struct {
+	node
+	queried		bool
+	responded	bool
+	failed		bool
+}
+
+type lookupReply struct {
+	candidate	*lookupCandidate
+	response	*KRPCResponse
+	err			error
+}
+
+// lookup is one iterative Kademlia search. The shortlist is kept ordered by
+// XOR distance to the target.
+type lookup struct {
+	dht			*DHTNode
+	self		IDType		// our ID when the lookup started
+	target		IDType
+	query		func(ctx context.Context,addr *net.UDPAddr) (*KRPCResponse,error)
+
+	shortlist	[]*lookupCandidate
+	seen		map[string]bool
+	peers		[]*net.TCPAddr
+	seenPeers	map[string]bool
+}
+
+func (this *DHTNode) newLookup(target IDType,
+	query func(ctx context.Context,addr *net.UDPAddr) (*KRPCResponse,error)) *lookup{
+	l := &lookup{
+		dht:		this,
+		self:		this.ID(),
+		target:		target,
+		query:		query,
+		seen:		make(map[string]bool),
+		seenPeers:	make(map[string]bool),
+	}
+	for _,o := range this.RT.ClosestNodes(&target,this.config.K){
+		l.add(o)
+	}
+	if this.udpconn6 != nil{
+		for _,o := range this.RT6.ClosestNodes(&target,this.config.K){
+			l.add(o)
+		}
+	}
+	return l
+}
+
+// add puts o into the shortlist unless it is already known.
+func (this *lookup) add(o node){
+	key := o.addr.String()
+	if this.seen[key] || o.id == this.self{
+		return
+	}
+	this.seen[key] = true
+
+	c := &lookupCandidate{node: o}
+	i := sort.Search(len(this.shortlist),func(i int) bool{
+		return closer(&this.target,&c.id,&this.shortlist[i].id) < 0
+	})
+	this.shortlist = append(this.shortlist,nil)
+	copy(this.shortlist[i+1:],this.shortlist[i:])
+	this.shortlist[i] = c
+}
+
+// next returns the closest candidate not yet queried among the k closest
+// that have not failed, or nil if all of them have been queried.
+func (this *lookup) next() *lookupCandidate{
+	n := 0
+	for _,c := range this.shortlist{
+		if c.failed{
+			continue
+		}
+		if !c.queried{
+			return c
+		}
+		if n++; n == this.dht.config.K{
+			break
+		}
+	}
+	return nil
+}
+
+// bootstrap queries the bootstrap routers when the routing table is empty.
+func (this *lookup) bootstrap(ctx context.Context){
+	routers := this.dht.config.BootstrapNodes
+	replies := make(chan *KRPCResponse,len(routers))
+	for i := range routers{
+		go func(address string) {
+			var R *KRPCResponse
+			if addr,err := net.ResolveUDPAddr("udp",address); err == nil{
+				R,_ = this.query(ctx,addr)
+			}
+			replies <- R
+		}(routers[i])
+	}
+	for range routers{
+		if R := <-replies; R != nil{
+			this.handle(R)
+		}
+	}
+}
+
+func (this *lookup) handle(R *KRPCResponse){
+	for _,o := range R.nodes{
+		this.add(*o)
+	}
+	if this.dht.udpconn6 != nil{
+		for _,o := range R.nodes6{
+			this.add(*o)
+		}
+	}
+	for _,peer := range R.values{
+		addr := peer.TCPAddr()
+		if this.seenPeers[addr.String()] || this.dht.guard.blocked(addr.IP){
+			continue
+		}
+		this.seenPeers[addr.String()] = true
+		this.peers = append(this.peers,addr)
+	}
+}
+
+// run queries candidates, Alpha at a time, until the k closest nodes
+// have all answered or failed, and returns the k closest that answered.
+func (this *lookup) run(ctx context.Context) ([]CompactNodeInfo,error){
+	if len(this.shortlist) == 0{
+		this.bootstrap(ctx)
+	}
+
+	alpha,k := this.dht.config.Alpha,this.dht.config.K
+	replies := make(chan lookupReply,alpha)
+	inflight := 0
+	for{
+		for inflight < alpha{
+			c := this.next()
+			if c == nil{
+				break
+			}
+			c.queried = true
+			inflight++
+			go func() {
+				R,err := this.query(ctx,&c.addr)
+				replies <- lookupReply{c,R,err}
+			}()
+		}
+		if inflight == 0{
+			break
+		}
+
+		select {
+		case reply := <-replies:
+			inflight--
+			if reply.err != nil{
+				reply.candidate.failed = true
+				continue
+			}
+			reply.candidate.responded = true
+			this.handle(reply.response)
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+	}
+
+	ret := make([]CompactNodeInfo,0,k)
+	for _,c := range this.shortlist{
+		if c.responded{
+			ret = append(ret,CompactNodeInfo{c.id,c.addr})
+			if len(ret) == k{
+				break
+			}
+		}
+	}
+	return ret,nil
+}
+
+// LookupNodes searches the network for the k nodes closest to target.
+func (this *DHTNode) LookupNodes(ctx context.Context,target IDType) ([]CompactNodeInfo,error){
+	l := this.newLookup(target,func(ctx context.Context,addr *net.UDPAddr) (*KRPCResponse,error){
+		return this.Query(ctx,addr,&KRPCQuery{
+			Type:		FindNodeType,
+			queryingID:	target,
+			want:		this.want(),
+		})
+	})
+	return l.run(ctx)
+}
+
+// LookupPeers searches the network for peers of infohash. It returns the
+// peers found on the way and the k nodes closest to infohash.
+func (this *DHTNode) LookupPeers(ctx context.Context,infohash IDType) ([]*net.TCPAddr,[]CompactNodeInfo,error){
+	l := this.newLookup(infohash,func(ctx context.Context,addr *net.UDPAddr) (*KRPCResponse,error){
+		return this.GetPeers(ctx,addr,infohash[:])
+	})
+	nodes,err := l.run(ctx)
+	if err != nil{
+		return nil,nil,err
+	}
+	return l.peers,nodes,nil
+}
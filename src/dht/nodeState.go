@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"time"
+)
+
+// Node quality as defined in BEP 5.
+const (
+	nodeGood = iota
+	nodeQuestionable
+	nodeBad
+)
+
+// maxFailures unanswered queries in a row make a node bad.
+const maxFailures = 2
+
+// nodeState is what the routing table knows about the liveness of a node.
+type nodeState struct {
+	lastResponse	time.Time	// last answer to one of our queries
+	lastQuery		time.Time	// last query it sent us
+	failures		int			// unanswered queries in a row
+}
+
+// quality classifies the node. A node is good if it answered us within
+// goodFor, or if it has ever answered us and queried us within goodFor
+// (15 minutes in BEP 5). It is bad after maxFailures unanswered queries,
+// and questionable otherwise.
+func (this *nodeState) quality(now time.Time,goodFor time.Duration) int{
+	switch {
+	case this.failures >= maxFailures:
+		return nodeBad
+	case now.Sub(this.lastResponse) < goodFor:
+		return nodeGood
+	case !this.lastResponse.IsZero() && now.Sub(this.lastQuery) < goodFor:
+		return nodeGood
+	}
+	return nodeQuestionable
+}
+
+// lastSeen is the time the node last showed any sign of life.
+func (this *nodeState) lastSeen() time.Time{
+	if this.lastQuery.After(this.lastResponse){
+		return this.lastQuery
+	}
+	return this.lastResponse
+}
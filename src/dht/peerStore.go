@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	peerExpiry				= 30 * time.Minute
+	peerSweepInterval		= 1 * time.Minute
+
+	// maxValues bounds the peers sent in one get_peers response so that it
+	// stays well inside a UDP packet.
+	maxValues				= 50
+)
+
+type swarm struct {
+	peers		map[string]time.Time	// compact peer -> last announce
+	announces	int
+}
+
+// SwarmStats describes one infohash in a PeerStore.
+type SwarmStats struct {
+	InfoHash	IDType
+	Peers		int
+	Announces	int
+}
+
+// PeerStore keeps the peers announced to us, by infohash. A peer is
+// forgotten 30 minutes after its last announce. Once a swarm or the whole
+// store is full, a swarm drops its oldest peer for a new one and the store
+// refuses new peers until some expire.
+type PeerStore struct {
+	mu				sync.Mutex
+	swarms			map[IDType]*swarm
+	total			int
+	maxSwarmPeers	int
+	maxPeers		int
+	swept			time.Time
+	clock			Clock
+}
+
+// NewPeerStore returns a store holding at most maxSwarmPeers peers per
+// infohash and maxPeers in total.
+func NewPeerStore(maxSwarmPeers,maxPeers int) *PeerStore{
+	return newPeerStore(maxSwarmPeers,maxPeers,systemClock{})
+}
+
+func newPeerStore(maxSwarmPeers,maxPeers int,clock Clock) *PeerStore{
+	return &PeerStore{
+		swarms:			make(map[IDType]*swarm),
+		maxSwarmPeers:	maxSwarmPeers,
+		maxPeers:		maxPeers,
+		swept:			clock.Now(),
+		clock:			clock,
+	}
+}
+
+// Add records an announce of addr for infohash.
+func (this *PeerStore) Add(infohash IDType,addr *net.TCPAddr){
+	value := string(CompactPeerInfo{addr.IP,addr.Port}.Encode())
+	now := this.clock.Now()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if now.Sub(this.swept) >= peerSweepInterval{
+		this.sweep(now)
+	}
+
+	s,ok := this.swarms[infohash]
+	if !ok{
+		if this.total >= this.maxPeers{
+			return
+		}
+		s = &swarm{peers: make(map[string]time.Time)}
+		this.swarms[infohash] = s
+	}
+	s.announces++
+	if _,ok := s.peers[value]; ok{
+		s.peers[value] = now
+		return
+	}
+
+	if len(s.peers) >= this.maxSwarmPeers{
+		this.evictOldest(s)
+	}else if this.total >= this.maxPeers{
+		return
+	}
+	s.peers[value] = now
+	this.total++
+}
+
+func (this *PeerStore) evictOldest(s *swarm){
+	var oldest string
+	var oldestTime time.Time
+	for value,seen := range s.peers{
+		if oldestTime.IsZero() || seen.Before(oldestTime){
+			oldest,oldestTime = value,seen
+		}
+	}
+	delete(s.peers,oldest)
+	this.total--
+}
+
+// sweep drops expired peers and empty swarms.
+func (this *PeerStore) sweep(now time.Time){
+	for infohash,s := range this.swarms{
+		for value,seen := range s.peers{
+			if now.Sub(seen) >= peerExpiry{
+				delete(s.peers,value)
+				this.total--
+			}
+		}
+		if len(s.peers) == 0{
+			delete(this.swarms,infohash)
+		}
+	}
+	this.swept = now
+}
+
+// live returns the unexpired peers of infohash in compact form, at most n
+// of them if n >= 0.
+func (this *PeerStore) live(infohash IDType,n int) []string{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	s,ok := this.swarms[infohash]
+	if !ok{
+		return nil
+	}
+
+	now := this.clock.Now()
+	ret := make([]string,0,len(s.peers))
+	for value,seen := range s.peers{
+		if n >= 0 && len(ret) == n{
+			break
+		}
+		if now.Sub(seen) < peerExpiry{
+			ret = append(ret,value)
+		}
+	}
+	return ret
+}
+
+// values returns peers of infohash for a get_peers response.
+func (this *PeerStore) values(infohash IDType) []CompactPeerInfo{
+	values := this.live(infohash,maxValues)
+	ret := make([]CompactPeerInfo,0,len(values))
+	for _,v := range values{
+		if peer,err := DecodeCompactPeerInfo([]byte(v)); err == nil{
+			ret = append(ret,peer)
+		}
+	}
+	return ret
+}
+
+// Peers returns the peers announced for infohash.
+func (this *PeerStore) Peers(infohash IDType) []*net.TCPAddr{
+	values := this.live(infohash,-1)
+	ret := make([]*net.TCPAddr,0,len(values))
+	for _,v := range values{
+		if peer,err := DecodeCompactPeerInfo([]byte(v)); err == nil{
+			ret = append(ret,peer.TCPAddr())
+		}
+	}
+	return ret
+}
+
+// Top returns the n infohashes announced most often, busiest first. It
+// returns none for n <= 0.
+func (this *PeerStore) Top(n int) []SwarmStats{
+	if n <= 0{
+		return nil
+	}
+	this.mu.Lock()
+	ret := make([]SwarmStats,0,len(this.swarms))
+	for infohash,s := range this.swarms{
+		ret = append(ret,SwarmStats{
+			InfoHash:	infohash,
+			Peers:		len(s.peers),
+			Announces:	s.announces,
+		})
+	}
+	this.mu.Unlock()
+
+	sort.Slice(ret,func(i,j int) bool{
+		return ret[i].Announces > ret[j].Announces
+	})
+	if len(ret) > n{
+		ret = ret[:n]
+	}
+	return ret
+}
@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateFileVersion is bumped whenever stateFile changes incompatibly.
+const stateFileVersion = 1
+
+const durationToBackup = 1 * time.Minute
+
+// stateFile is what a node saves between runs: its ID and the good nodes of
+// its routing tables.
+type stateFile struct {
+	Version	int			`json:"version"`
+	ID		string		`json:"id"`
+	Nodes	[]stateNode	`json:"nodes"`
+}
+
+type stateNode struct {
+	ID		string	`json:"id"`
+	Addr	string	`json:"addr"`
+}
+
+func loadState(path string) (*stateFile,error){
+	f,err := os.Open(path)
+	if err != nil{
+		return nil,err
+	}
+	defer f.Close()
+
+	var st stateFile
+	if err := json.NewDecoder(f).Decode(&st); err != nil{
+		return nil,err
+	}
+	if st.Version != stateFileVersion{
+		return nil,fmt.Errorf("%s: unsupported version %d",path,st.Version)
+	}
+	return &st,nil
+}
+
+// saveState writes st to a temporary file next to path and renames it over
+// path, so a crash never leaves a half-written file behind.
+// The file is synced first: otherwise the rename may reach the disk before
+// the data and leave an empty file after a power loss.
+func saveState(path string,st *stateFile) error{
+	f,err := os.CreateTemp(filepath.Dir(path),filepath.Base(path) + ".*.tmp")
+	if err != nil{
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = json.NewEncoder(f).Encode(st)
+	if err == nil{
+		err = f.Sync()
+	}
+	if err != nil{
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil{
+		return err
+	}
+	return os.Rename(f.Name(),path)
+}
+
+func (this *stateFile) id() (IDType,error){
+	var id IDType
+	data,err := hex.DecodeString(this.ID)
+	if err != nil || len(data) != len(id){
+		return id,errors.New("invalid node id in state file")
+	}
+	copy(id[:],data)
+	return id,nil
+}
+
+func (this *stateFile) nodes() []node{
+	ret := make([]node,0,len(this.Nodes))
+	for _,o := range this.Nodes{
+		data,err := hex.DecodeString(o.ID)
+		if err != nil || len(data) != len(IDType{}){
+			continue
+		}
+		addr,err := net.ResolveUDPAddr("udp",o.Addr)
+		if err != nil{
+			continue
+		}
+		var id IDType
+		copy(id[:],data)
+		ret = append(ret,node{id,*addr})
+	}
+	return ret
+}
+
+// saveState saves the node ID and the good nodes of both routing tables to
+// the configured StateFile.
+func (this *DHTNode) saveState() error{
+	if this.config.StateFile == ""{
+		return nil
+	}
+	id := this.ID()
+	st := &stateFile{
+		Version:	stateFileVersion,
+		ID:			hex.EncodeToString(id[:]),
+	}
+	for _,rt := range []*routingTable{this.RT,this.RT6}{
+		for _,o := range rt.GoodNodes(){
+			st.Nodes = append(st.Nodes,stateNode{
+				ID:		hex.EncodeToString(o.id[:]),
+				Addr:	o.addr.String(),
+			})
+		}
+	}
+	return saveState(this.config.StateFile,st)
+}
+
+// pingSeeds pings the nodes saved by the last run; those that answer go
+// into the routing tables.
+func (this *DHTNode) pingSeeds(ctx context.Context){
+	var wg sync.WaitGroup
+	for i := range this.seeds{
+		wg.Add(1)
+		go func(o *node) {
+			defer wg.Done()
+			_,_ = this.Query(ctx,&o.addr,&KRPCQuery{Type: PingType})
+		}(&this.seeds[i])
+	}
+	wg.Wait()
+	this.seeds = nil
+}
@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"context"
+	"nat"
+	"net"
+	"time"
+)
+
+const (
+	portMapLifetime		= 1 * time.Hour
+	portMapRetry		= 1 * time.Minute
+	portMapTimeout		= 10 * time.Second
+)
+
+// cgnat is the shared address space of carrier-grade NATs (RFC 6598): a
+// gateway reporting such an address is itself behind another NAT.
+var cgnat = &net.IPNet{IP: net.IPv4(100,64,0,0),Mask: net.CIDRMask(10,32)}
+
+// mapPort keeps our IPv4 port mapped on the configured PortMapper until
+// shutdown, renewing the mapping halfway through each lease, and removes
+// it on the way out.
+func (this *DHTNode) mapPort(mapper nat.Mapper){
+	defer this.goroutines.Done()
+	port := this.udpconn.LocalAddr().(*net.UDPAddr).Port
+	external := 0
+	for{
+		want := external
+		if want == 0{
+			want = port
+		}
+		wait := portMapRetry
+		ctx,cancel := context.WithTimeout(this.ctx,portMapTimeout)
+		mapped,err := mapper.AddMapping(ctx,"udp",port,want,portMapLifetime)
+		var ip net.IP
+		if err == nil{
+			external = mapped
+			ip,err = mapper.ExternalIP(ctx)
+		}
+		cancel()
+		if err == nil{
+			this.setMappedAddr(&net.UDPAddr{IP: ip,Port: external})
+			wait = portMapLifetime / 2
+		}else if this.ctx.Err() == nil{
+			this.logger.Println("port mapping: ",err)
+		}
+
+		renew,timer := after(this.config.Clock,wait)
+		select {
+		case <-this.quitEvent:
+			timer.Stop()
+			if external != 0{
+				ctx,cancel := context.WithTimeout(context.Background(),portMapTimeout)
+				if err := mapper.DeleteMapping(ctx,"udp",port,external); err != nil{
+					this.logger.Println("port mapping: ",err)
+				}
+				cancel()
+			}
+			return
+		case <-renew:
+		}
+	}
+}
+
+// setMappedAddr records the address opened by the port mapper. Until the
+// other nodes elect an address, a public one also decides our ID.
+func (this *DHTNode) setMappedAddr(addr *net.UDPAddr){
+	if !this.externalAddr.setMapped(addr){
+		return
+	}
+	this.logger.Println("mapped address: ",addr)
+	if !isLocalIP(addr.IP) && !cgnat.Contains(addr.IP){
+		this.adoptExternalIP(addr.IP)
+	}
+}
@@ -0,0 +1,148 @@
+package dht
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("send rate limit exceeded")
+
+// ResponseKind is the kind under which responses and error replies are
+// limited and counted; queries use their method name. Replies are sent by
+// the packet handlers, which must not block, so they are never held back:
+// a reply over the budget is dropped.
+const ResponseKind = "response"
+
+// SendStats counts the packets of one kind that went through the limiter.
+type SendStats struct {
+	Sent		int64	// let through, deferred or not
+	Deferred	int64	// held back before being sent
+	Dropped		int64	// not sent: they would have waited too long, or were replies over the budget
+}
+
+// tokenBucket refills rate tokens per second up to one second's worth.
+// Tokens can be taken ahead of time, which leaves the bucket in debt.
+type tokenBucket struct {
+	rate		float64
+	burst		float64
+	tokens		float64
+	last		time.Time
+}
+
+func newTokenBucket(rate float64,now time.Time) *tokenBucket{
+	burst := math.Max(rate,1)
+	return &tokenBucket{rate,burst,burst,now}
+}
+
+// reserve takes a token and returns how long until it is earned.
+func (this *tokenBucket) reserve(now time.Time) time.Duration{
+	this.tokens = math.Min(this.burst,this.tokens + now.Sub(this.last).Seconds() * this.rate)
+	this.last = now
+	this.tokens--
+	if this.tokens >= 0{
+		return 0
+	}
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
+
+func (this *tokenBucket) cancel(){
+	this.tokens++
+}
+
+// sendLimiter holds outgoing packets to a total rate and a rate per kind.
+type sendLimiter struct {
+	mu			sync.Mutex
+	total		*tokenBucket				// nil if unlimited
+	kinds		map[string]*tokenBucket
+	maxDelay	time.Duration
+	stats		map[string]*SendStats
+	clock		Clock
+}
+
+func newSendLimiter(config *Config) *sendLimiter{
+	now := config.Clock.Now()
+	ret := &sendLimiter{
+		kinds:		make(map[string]*tokenBucket),
+		maxDelay:	config.MaxSendDelay,
+		stats:		make(map[string]*SendStats),
+		clock:		config.Clock,
+	}
+	if config.MaxPacketRate > 0{
+		ret.total = newTokenBucket(config.MaxPacketRate,now)
+	}
+	for kind,rate := range config.SendRates{
+		if rate > 0{
+			ret.kinds[kind] = newTokenBucket(rate,now)
+		}
+	}
+	return ret
+}
+
+// reserve books a packet of kind and returns how long to hold it, or
+// ErrRateLimited if that is longer than maxDelay, or at all for a reply.
+func (this *sendLimiter) reserve(kind string) (time.Duration,error){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	st,ok := this.stats[kind]
+	if !ok{
+		st = &SendStats{}
+		this.stats[kind] = st
+	}
+
+	now := this.clock.Now()
+	var delay time.Duration
+	var taken []*tokenBucket
+	for _,b := range []*tokenBucket{this.total,this.kinds[kind]}{
+		if b == nil{
+			continue
+		}
+		taken = append(taken,b)
+		if d := b.reserve(now); d > delay{
+			delay = d
+		}
+	}
+
+	maxDelay := this.maxDelay
+	if kind == ResponseKind{
+		maxDelay = 0
+	}
+	if delay > maxDelay{
+		for _,b := range taken{
+			b.cancel()
+		}
+		st.Dropped++
+		return 0,ErrRateLimited
+	}
+	if delay > 0{
+		st.Deferred++
+	}
+	st.Sent++
+	return delay,nil
+}
+
+func (this *sendLimiter) snapshot() map[string]SendStats{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ret := make(map[string]SendStats,len(this.stats))
+	for kind,st := range this.stats{
+		ret[kind] = *st
+	}
+	return ret
+}
+
+// SendStats returns the limiter's counters by query method, and under
+// ResponseKind for responses.
+func (this *DHTNode) SendStats() map[string]SendStats{
+	return this.limiter.snapshot()
+}
+
+// allow takes a token if one is available now.
+func (this *tokenBucket) allow(now time.Time) bool{
+	if this.reserve(now) > 0{
+		this.cancel()
+		return false
+	}
+	return true
+}
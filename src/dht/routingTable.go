@@ -1,10 +1,10 @@
 package dht
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"errors"
+	"math/bits"
 	"net"
-	"os"
 	"sort"
 	"time"
 )
@@ -19,124 +19,144 @@ type Kbucket struct{
 
 type IDType [keySize/8]byte
 
-func newKbucket() *Kbucket{
+func newKbucket(now time.Time) *Kbucket{
 	return &Kbucket{
 	//	k,
-		time.Now(),
+		now,
 		make([]*node,0),
 		make([]*node,0),
 	}
 }
 
-func (this *Kbucket) updateTime(){
-	this.LastUpdateTime = time.Now()
+func (this *Kbucket) updateTime(now time.Time){
+	this.LastUpdateTime = now
 }
 
 
-func (this *Kbucket)TryUpdate(o *node) bool{
+func (this *Kbucket)TryUpdate(o *node,now time.Time) bool{
 	for i := range this.Entry{
 		if this.Entry[i].id == o.id{
 			copy(this.Entry[1:],this.Entry[:i])
 			this.Entry[0] = o
-			this.updateTime()
+			this.updateTime(now)
 			return true
 		}
 	}
 	return false
 }
 
-func (this *Kbucket) PushFront(o *node){
+func (this *Kbucket) PushFront(o *node,now time.Time){
 	this.Entry = append(this.Entry,nil)
 	copy(this.Entry[1:],this.Entry)
 	this.Entry[0]  = o
-	this.updateTime()
+	this.updateTime(now)
 }
 
 /*type <Kbucket> Ends here*/
 
+// Checker is how the routing table reaches the network. Ping returns nil
+// only if the node answered, and an error for which notSent holds if the
+// ping could not be sent; Refresh looks up target to fill the bucket it
+// falls in.
 type Checker interface {
 	Ping(*net.UDPAddr) error
+	Refresh(target IDType)
 }
 
+// routingTable is owned by the goroutine running routine: all its state is
+// read and written there only, and the public methods talk to it through
+// channels.
 type routingTable struct {
 
-	k 			int
+	config		*Config
+	rand		*lockedRand
 	id			IDType
 	bucket		[]*Kbucket
 
-	timeoutTimers	map[*node]*time.Timer
-	pingTimers      map[*node]*time.Timer
-	failed			map[*node]int
-	knownNodes		map[IDType]*node
+	pingTimers      map[IDType]Timer
+	states			map[IDType]*nodeState	// entries and candidates
+	verifying		map[IDType]bool			// unknown nodes being pinged
 
 	pingEvent 		chan *node
-	timeoutEvent  	chan *node
+	pingDoneEvent  	chan pingResult
 	closeEvent 		chan struct{}
-	notifyEvent		chan *node
+	doneEvent		chan struct{}
+	notifyEvent		chan nodeEvent
+	closestEvent	chan *closestRequest
+	snapshotEvent	chan chan [][]node
+	goodEvent		chan chan []node
+	resetEvent		chan IDType
 
 	checker 		Checker
+}
 
-	file            string
-}
-
-func getBucketID(a,b *IDType) int{
-	if a == b{
-		return 0
-	}
-	var bitDiff int
-	for i,bit := range a {
-		v := bit ^ b[i]
-		switch {
-		case v > 0x70:
-			bitDiff = 8
-			return i*8 + (8 - bitDiff)
-		case v > 0x40:
-			bitDiff = 7
-			return i*8 + (8 - bitDiff)
-		case v > 0x20:
-			bitDiff = 6
-			return i*8 + (8 - bitDiff)
-		case v > 0x10:
-			bitDiff = 5
-			return i*8 + (8 - bitDiff)
-		case v > 0x08:
-			bitDiff = 4
-			return i*8 + (8 - bitDiff)
-		case v > 0x04:
-			bitDiff = 3
-			return i*8 + (8 - bitDiff)
-		case v > 0x02:
-			bitDiff = 2
-			return i*8 + (8 - bitDiff)
+// commonPrefixLen returns the number of leading bits a and b share, keySize
+// if they are equal.
+func commonPrefixLen(a,b *IDType) int{
+	for i := range a{
+		if v := a[i] ^ b[i]; v != 0{
+			return i*8 + bits.LeadingZeros8(v)
 		}
 	}
-	return -1
+	return keySize
+}
+
+// bucketIndex returns the bucket id belongs in. The table is the Kademlia
+// tree in which only the subtree holding our own ID is ever split, so it is
+// stored as a list: bucket i holds the nodes sharing exactly i leading bits
+// with us, and the last bucket holds everything closer.
+func (this *routingTable) bucketIndex(id *IDType) int{
+	return Min(commonPrefixLen(&this.id,id),len(this.bucket) - 1)
+}
+
+// split divides the last bucket, which holds our own ID, in two.
+func (this *routingTable) split(){
+	n := len(this.bucket) - 1
+	old := this.bucket[n]
+	next := newKbucket(this.config.Clock.Now())
+	this.bucket = append(this.bucket,next)
+
+	entry,candidate := old.Entry[:0:0],old.Candidate[:0:0]
+	for _,o := range old.Entry{
+		if commonPrefixLen(&this.id,&o.id) > n{
+			next.Entry = append(next.Entry,o)
+		}else{
+			entry = append(entry,o)
+		}
+	}
+	for _,o := range old.Candidate{
+		if commonPrefixLen(&this.id,&o.id) > n{
+			next.Candidate = append(next.Candidate,o)
+		}else{
+			candidate = append(candidate,o)
+		}
+	}
+	old.Entry,old.Candidate = entry,candidate
 }
+
 /*Functions about events*/
 const (
-	responseTimeout			= 1	 * time.Second
-	durationToBackup		= 1  * time.Minute
-	durationToPing			= 15 * time.Minute
+	refreshInterval			= 1  * time.Minute
 )
 
-func(this *routingTable) deletePingEvent(o *node){
-	timer,ok := this.pingTimers[o]
-	if ok {
-		timer.Stop()
-		delete(this.pingTimers,o)
-	}
+// nodeEvent reports that o answered one of our queries (response) or sent
+// us a query.
+type nodeEvent struct {
+	o			*node
+	response	bool
 }
 
-func(this *routingTable) deleteTimeoutEvent(o *node){
-	timer,ok := this.timeoutTimers[o]
+func(this *routingTable) deletePingEvent(o *node){
+	timer,ok := this.pingTimers[o.id]
 	if ok {
 		timer.Stop()
-		delete(this.timeoutTimers,o)
+		delete(this.pingTimers,o.id)
 	}
 }
 
 func (this *routingTable) registerPingEvent(dur time.Duration,o *node){
-	this.pingTimers[o] = time.AfterFunc(dur, func() {
+	this.deletePingEvent(o)
+	this.pingTimers[o.id] = this.config.Clock.AfterFunc(dur, func() {
 		select {
 			case this.pingEvent <- o:
 			case <- this.closeEvent :
@@ -144,216 +164,502 @@ func (this *routingTable) registerPingEvent(dur time.Duration,o *node){
 	})
 }
 
-func (this *routingTable) registerTimeoutEvent(dur time.Duration,o *node){
-	this.pingTimers[o] = time.AfterFunc(dur, func() {
-		select {
-		case this.timeoutEvent <- o:
-		case <- this.closeEvent :
+func (this *Kbucket) find(id IDType) int{
+	for i := range this.Entry{
+		if this.Entry[i].id == id{
+			return i
 		}
-	})
+	}
+	return -1
+}
+
+func (this *Kbucket) findCandidate(id IDType) int{
+	for i := range this.Candidate{
+		if this.Candidate[i].id == id{
+			return i
+		}
+	}
+	return -1
 }
 
-func (this *routingTable)notify(o *node){
-	n := getBucketID(&this.id,&o.id)
-	if n == -1{
-		log.Println("invaild bucket id from",this.id,o.id)
+// stored returns the entry or candidate with ID id, or nil.
+func (this *Kbucket) stored(id IDType) *node{
+	if i := this.find(id); i >= 0{
+		return this.Entry[i]
+	}
+	if i := this.findCandidate(id); i >= 0{
+		return this.Candidate[i]
+	}
+	return nil
+}
+
+func sameAddr(a,b *net.UDPAddr) bool{
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// notify records a sign of life from o. Only nodes that answered one of our
+// queries are added; an unknown node that queried us is pinged first if
+// there is room for it. A known ID at another address is left to moved.
+func (this *routingTable)notify(ev nodeEvent){
+	o := ev.o
+	if o.id == this.id{
 		return
 	}
+	now := this.config.Clock.Now()
+	n := this.bucketIndex(&o.id)
 	bkt := this.bucket[n]
 
-	this.failed[o] = 0
-	if bkt.TryUpdate(o){
-		this.deleteTimeoutEvent(o)
-		this.deletePingEvent(o)
-		this.registerPingEvent(durationToPing,o)
-	}else if len(bkt.Entry) < this.k{
-		bkt.PushFront(o)
-		this.registerPingEvent(durationToPing,o)
-	}else {
-		bkt.Candidate = append(bkt.Candidate,o)
-		if len(bkt.Candidate) > this.k {
-			copy(bkt.Candidate,bkt.Candidate[1:])
-			bkt.Candidate = bkt.Candidate[:this.k]
+	if st,ok := this.states[o.id]; ok{
+		if old := bkt.stored(o.id); old != nil && !sameAddr(&old.addr,&o.addr){
+			this.moved(bkt,o,st,ev.response)
+			return
+		}
+		if ev.response{
+			st.lastResponse = now
+			st.failures = 0
+		}else{
+			st.lastQuery = now
 		}
+		if bkt.find(o.id) >= 0 && st.quality(now,this.config.PingInterval) == nodeGood{
+			bkt.TryUpdate(o,now)
+			this.registerPingEvent(this.config.PingInterval,o)
+		}
+		return
 	}
+
+	if !ev.response{
+		room := len(bkt.Entry) < this.config.K || n == len(this.bucket) - 1 && n < keySize - 1 ||
+			this.insecureEntry(bkt) >= 0 && ValidNodeID(o.addr.IP,o.id)
+		if room && !this.verifying[o.id]{
+			this.verifying[o.id] = true
+			this.ping(o)
+		}
+		return
+	}
+	delete(this.verifying,o.id)
+	this.add(o,&nodeState{lastResponse: now})
 }
 
-func closer(target,A,B *IDType) int {
-	for i := range target{
-		a := A[i] ^ target[i]
-		b := B[i] ^ target[i]
-		if a > b{
-			return 1
-		}else if a < b{
-			return -1
+// moved handles o claiming the ID of a node we know at another address:
+// the node moved, or someone spoofs its ID. A good node keeps its slot;
+// otherwise the new address takes it over once it answers one of our
+// queries, and a query from it only gets it pinged.
+func (this *routingTable) moved(bkt *Kbucket,o *node,st *nodeState,response bool){
+	now := this.config.Clock.Now()
+	if st.quality(now,this.config.PingInterval) == nodeGood{
+		return
+	}
+	if !response{
+		if !this.verifying[o.id]{
+			this.verifying[o.id] = true
+			this.ping(o)
 		}
+		return
+	}
+
+	delete(this.verifying,o.id)
+	*st = nodeState{lastResponse: now}
+	if i := bkt.find(o.id); i >= 0{
+		bkt.Entry[i] = o
+		bkt.TryUpdate(o,now)
+		this.registerPingEvent(this.config.PingInterval,o)
+	}else if i := bkt.findCandidate(o.id); i >= 0{
+		bkt.Candidate[i] = o
 	}
-	return 0
 }
 
-// TODO: <load> <save> <routines>
-func (this *routingTable) loadFromFile(filepath string) error {
-	f, err := os.Open(filepath)
-	if err != nil {
-		return err
+// current reports whether o is the node we store under its ID, at the
+// same address.
+func (this *routingTable) current(o *node) bool{
+	old := this.bucket[this.bucketIndex(&o.id)].stored(o.id)
+	return old != nil && sameAddr(&old.addr,&o.addr)
+}
+
+// add puts the new node o with state st in its bucket, splitting the bucket
+// of our own ID as needed. A full bucket keeps o as a replacement, unless
+// SecureIDs is set and o has a BEP 42 ID while an entry has not.
+func (this *routingTable) add(o *node,st *nodeState){
+	now := this.config.Clock.Now()
+	n := this.bucketIndex(&o.id)
+	bkt := this.bucket[n]
+	this.states[o.id] = st
+
+	if len(bkt.Entry) < this.config.K{
+		bkt.PushFront(o,now)
+		this.registerPingEvent(this.config.PingInterval,o)
+	}else if n == len(this.bucket) - 1 && n < keySize - 1{
+		// the full bucket holds our own ID: split it and try again.
+		this.split()
+		this.add(o,st)
+	}else if i := this.insecureEntry(bkt); i >= 0 && ValidNodeID(o.addr.IP,o.id){
+		old := bkt.Entry[i]
+		bkt.Entry = append(bkt.Entry[:i],bkt.Entry[i+1:]...)
+		this.deletePingEvent(old)
+		this.addCandidate(bkt,old)
+		bkt.PushFront(o,now)
+		this.registerPingEvent(this.config.PingInterval,o)
+	}else {
+		this.addCandidate(bkt,o)
 	}
+}
 
-	data := struct {
-		id IDType
-		Buckets []*Kbucket
-	}{}
+// addCandidate keeps o as a replacement for when an entry goes bad.
+func (this *routingTable) addCandidate(bkt *Kbucket,o *node){
+	bkt.Candidate = append(bkt.Candidate,o)
+	if len(bkt.Candidate) > this.config.K {
+		delete(this.states,bkt.Candidate[0].id)
+		copy(bkt.Candidate,bkt.Candidate[1:])
+		bkt.Candidate = bkt.Candidate[:this.config.K]
+	}
+}
 
-	err = json.NewDecoder(f).Decode(&data)
-	if err != nil {
-		return err
+// insecureEntry returns the oldest entry of bkt without a BEP 42 ID, or -1
+// if there is none or SecureIDs is off.
+func (this *routingTable) insecureEntry(bkt *Kbucket) int{
+	if !this.config.SecureIDs{
+		return -1
+	}
+	for i := len(bkt.Entry) - 1; i >= 0; i--{
+		if !ValidNodeID(bkt.Entry[i].addr.IP,bkt.Entry[i].id){
+			return i
+		}
 	}
+	return -1
+}
 
-	this.id = data.id
-	for bktid := range data.Buckets {
-		bkt := data.Buckets[bktid]
-		if bkt != nil {
-			for i := range bkt.Entry{
-				this.Notify(bkt.Entry[i])
-			}
+// reset moves the table to our new ID id: the buckets are rebuilt around
+// it and every entry and candidate is put back with its state.
+func (this *routingTable) reset(id IDType){
+	var nodes []*node
+	for _,bkt := range this.bucket{
+		nodes = append(nodes,bkt.Entry...)
+		nodes = append(nodes,bkt.Candidate...)
+	}
+	this.id = id
+	this.bucket = []*Kbucket{newKbucket(this.config.Clock.Now())}
+	for _,o := range nodes{
+		st,ok := this.states[o.id]
+		if !ok{
+			st = &nodeState{}
+		}
+		delete(this.states,o.id)
+		this.deletePingEvent(o)
+		if o.id != id{
+			this.add(o,st)
 		}
 	}
+}
 
-	return nil
+// checkNode runs when o has been quiet for PingInterval: a node that is
+// no longer good gets pinged.
+func (this *routingTable) checkNode(o *node){
+	st,ok := this.states[o.id]
+	if !ok || this.bucket[this.bucketIndex(&o.id)].find(o.id) < 0{
+		return
+	}
+	now := this.config.Clock.Now()
+	if st.quality(now,this.config.PingInterval) == nodeGood{
+		this.registerPingEvent(st.lastSeen().Add(this.config.PingInterval).Sub(now),o)
+		return
+	}
+	this.ping(o)
+}
+
+// refresh looks up a random ID in every bucket nothing happened in for
+// RefreshInterval.
+func (this *routingTable) refresh(){
+	now := this.config.Clock.Now()
+	for i,bkt := range this.bucket{
+		if now.Sub(bkt.LastUpdateTime) < this.config.RefreshInterval{
+			continue
+		}
+		bkt.updateTime(now)
+		target := this.randomID(i)
+		go this.checker.Refresh(target)
+	}
 }
 
-func (this *routingTable) saveToFile(filepath string) error {
-	f, err := os.Create(filepath)
-	if err != nil {
-		return err
+// randomID returns a random ID that falls in bucket i.
+func (this *routingTable) randomID(i int) IDType{
+	id := this.rand.id()
+	if i >= keySize{
+		return this.id
+	}
+	for b := 0; b < i; b++{
+		mask := byte(0x80) >> uint(b%8)
+		id[b/8] = id[b/8] &^ mask | this.id[b/8] & mask
+	}
+	if i < len(this.bucket) - 1{
+		// bucket i holds the IDs that differ from ours at bit i.
+		mask := byte(0x80) >> uint(i%8)
+		id[i/8] = id[i/8] &^ mask | ^this.id[i/8] & mask
+	}
+	return id
+}
+
+func closer(target,A,B *IDType) int {
+	for i := range target{
+		a := A[i] ^ target[i]
+		b := B[i] ^ target[i]
+		if a > b{
+			return 1
+		}else if a < b{
+			return -1
+		}
 	}
+	return 0
+}
 
-	defer f.Close()
+// pingResult reports whether o answered a ping, and whether the ping was
+// sent at all.
+type pingResult struct {
+	o			*node
+	answered	bool
+	sent		bool
+}
 
-	data := make(map[string]interface{})
-	data["OwnerID"] = this.id
-	data["Buckets"] = this.bucket
-	return json.NewEncoder(f).Encode(data)
+// notSent reports whether err means a query never left us: our own send
+// budget or transaction IDs ran out, or we are shutting down. That tells
+// nothing about the node queried.
+func notSent(err error) bool{
+	return errors.Is(err,ErrRateLimited) || errors.Is(err,ErrTooManyTransactions) ||
+		errors.Is(err,context.Canceled) || errors.Is(err,net.ErrClosed)
 }
 
+// ping checks o in the background. An answer refreshes o through Notify
+// from the checker; either way the result comes back as a pingResult, so
+// that o stops being verified even if it answered under another ID.
 func (this *routingTable) ping(o *node){
-	this.checker.Ping(&o.addr)
-	this.registerTimeoutEvent(responseTimeout,o)
+	go func() {
+		err := this.checker.Ping(&o.addr)
+		select {
+		case this.pingDoneEvent <- pingResult{o,err == nil,err == nil || !notSent(err)}:
+		case <- this.closeEvent:
+		}
+	}()
 }
 
+// deleteNode drops the bad entry o and promotes the replacement that
+// answered us most recently.
 func (this *routingTable) deleteNode(o *node){
-	bkt := this.bucket[getBucketID(&this.id,&o.id)]
-	i := 0
-	for i < len(bkt.Entry){
-		if bkt.Entry[i].id == o.id{
-			bkt.Entry = append(bkt.Entry[:i],bkt.Entry[i+1:]...)
-		}else {
-			i++
-		}
+	bkt := this.bucket[this.bucketIndex(&o.id)]
+	if i := bkt.find(o.id); i >= 0{
+		bkt.Entry = append(bkt.Entry[:i],bkt.Entry[i+1:]...)
 	}
+	this.deletePingEvent(o)
+	delete(this.states,o.id)
 
 	if len(bkt.Candidate) > 0 {
 		l := len(bkt.Candidate) - 1
-		bkt.PushFront(bkt.Candidate[l])
-		this.registerPingEvent(durationToPing,bkt.Candidate[l])
+		bkt.PushFront(bkt.Candidate[l],this.config.Clock.Now())
+		this.registerPingEvent(this.config.PingInterval,bkt.Candidate[l])
 		bkt.Candidate = bkt.Candidate[:l]
 	}
 }
 
 func (this *routingTable) handleTimeoutNode(o *node){
-	this.failed[o]++
-	if this.failed[o] > 1{
-		log.Println("delete node: ",o)
-		delete(this.failed,o)
-		this.deleteNode(o)
-	}else{
+	st,ok := this.states[o.id]
+	if !ok{
+		return
+	}
+	st.failures++
+	if st.quality(this.config.Clock.Now(),this.config.PingInterval) != nodeBad{
 		this.ping(o)
+		return
 	}
+
+	bkt := this.bucket[this.bucketIndex(&o.id)]
+	if i := bkt.findCandidate(o.id); i >= 0{
+		bkt.Candidate = append(bkt.Candidate[:i],bkt.Candidate[i+1:]...)
+		delete(this.states,o.id)
+		return
+	}
+	this.config.Logger.Println("delete node: ",o)
+	this.deleteNode(o)
+}
+
+type closestRequest struct {
+	target	IDType
+	n		int
+	reply	chan []node
 }
 
 func (this *routingTable) routine(){
-	backupTicker := time.NewTicker(durationToBackup)
-	defer backupTicker.Stop()
+	defer close(this.doneEvent)
+	refreshTicker := this.config.Clock.NewTicker(refreshInterval)
+	defer refreshTicker.Stop()
 	for{
 		select {
 		case nodeToPing := <-this.pingEvent:
-			log.Println("Wait to ping:",nodeToPing)
-			this.ping(nodeToPing)
-
-		case nodeTimeout := <-this.timeoutEvent:
-			log .Println("node timeout : ",nodeTimeout)
-			this.handleTimeoutNode(nodeTimeout)
-		case o := <-this.notifyEvent:
-			this.notify(o)
-		case <- backupTicker.C:
-			log.Println("routingTable backup.")
-			this.saveToFile(this.file)
+			this.checkNode(nodeToPing)
+
+		case res := <-this.pingDoneEvent:
+			delete(this.verifying,res.o.id)
+			switch {
+			case !this.current(res.o):
+				// a stranger claiming a known ID failed to prove it
+			case !res.sent:
+				// check again later rather than count a failure
+				this.registerPingEvent(this.config.PingInterval,res.o)
+			case !res.answered:
+				this.handleTimeoutNode(res.o)
+			}
+		case ev := <-this.notifyEvent:
+			this.notify(ev)
+		case req := <-this.closestEvent:
+			req.reply <- this.closestNodes(&req.target,req.n)
+		case reply := <-this.snapshotEvent:
+			reply <- this.snapshot()
+		case reply := <-this.goodEvent:
+			reply <- this.goodNodes()
+		case id := <-this.resetEvent:
+			this.reset(id)
+		case <- refreshTicker.Chan():
+			this.refresh()
+		case <- this.closeEvent:
+			for _,timer := range this.pingTimers{
+				timer.Stop()
+			}
+			return
 		}
 	}
 }
+
+func (this *routingTable) closestNodes(target *IDType,N int) []node{
+	ret := make([]node,0)
+	for _,bkt := range this.bucket{
+		for _,cur := range bkt.Entry{
+			ret = append(ret,*cur)
+		}
+	}
+	sort.Slice(ret,func(i,j int) bool{
+		return closer(target,&ret[i].id,&ret[j].id) < 0
+	})
+	if len(ret) > N{
+		ret = ret[:N]
+	}
+	return ret
+}
+
+func (this *routingTable) snapshot() [][]node{
+	ret := make([][]node,len(this.bucket))
+	for i,bkt := range this.bucket{
+		ret[i] = make([]node,len(bkt.Entry))
+		for j,o := range bkt.Entry{
+			ret[i][j] = *o
+		}
+	}
+	return ret
+}
 /*Public functions*/
 
+// Notify tells the table that o answered one of our queries.
 func (this *routingTable) Notify(o *node) {
-	log.Println("Notify: ",o.addr)
-	if old,ok := this.knownNodes[o.id];ok{
-		o = old
-	}else{
-		this.knownNodes[o.id] = o
+	select {
+		case <- this.closeEvent:
+		case this.notifyEvent <- nodeEvent{o,true}:
 	}
+}
 
+// NotifyQuery tells the table that o sent us a query.
+func (this *routingTable) NotifyQuery(o *node) {
 	select {
 		case <- this.closeEvent:
-		case this.notifyEvent <- o:
+		case this.notifyEvent <- nodeEvent{o,false}:
 	}
 }
+
+// Reset rebuilds the table around our new ID id.
+func (this *routingTable) Reset(id IDType){
+	select {
+		case <- this.closeEvent:
+		case this.resetEvent <- id:
+	}
+}
+
+// Stop ends the routing table's goroutine.
 func (this *routingTable) Stop(){
 	close(this.closeEvent)
-	this.saveToFile(this.file)
+	<-this.doneEvent
 }
 
+// ClosestNodes returns the N nodes closest to target, nearest first. It
+// returns nil once the table is stopped.
 func (this *routingTable) ClosestNodes(target *IDType,N int) []node{
-	ret := make([]node,0,N)
-	for i:=0;i<keySize;i++{
-		for _,cur := range this.bucket[i].Entry{
-			length := len(ret)
-			idx := sort.Search(length,func(i int) bool{
-				return closer(target,&cur.id,&ret[i].id) < 0
-			})
-			if idx == length{
-				if length < N {
-					ret = append(ret, *cur)
-				}
-			}else {
-				for j:= Min(N-1,length);j >idx; j--{
-					ret[j] = ret[j-1]
-				}
-				ret[idx] = *cur
+	req := &closestRequest{*target,N,make(chan []node,1)}
+	select {
+	case <- this.closeEvent:
+		return nil
+	case this.closestEvent <- req:
+		return <-req.reply
+	}
+}
+
+func (this *routingTable) goodNodes() []node{
+	now := this.config.Clock.Now()
+	ret := make([]node,0)
+	for _,bkt := range this.bucket{
+		for _,o := range bkt.Entry{
+			if st,ok := this.states[o.id]; ok && st.quality(now,this.config.PingInterval) == nodeGood{
+				ret = append(ret,*o)
 			}
 		}
 	}
 	return ret
 }
 
-func NewRoutingTable(myid IDType,_k int,_checker Checker) *routingTable{
+// Snapshot returns a copy of the entries of every bucket.
+func (this *routingTable) Snapshot() [][]node{
+	reply := make(chan [][]node,1)
+	select {
+	case <- this.closeEvent:
+		return nil
+	case this.snapshotEvent <- reply:
+		return <-reply
+	}
+}
+
+// GoodNodes returns the entries that are currently good.
+func (this *routingTable) GoodNodes() []node{
+	reply := make(chan []node,1)
+	select {
+	case <- this.closeEvent:
+		return nil
+	case this.goodEvent <- reply:
+		return <-reply
+	}
+}
+
+// Size returns the number of nodes in the table.
+func (this *routingTable) Size() int{
+	size := 0
+	for _,bkt := range this.Snapshot(){
+		size += len(bkt)
+	}
+	return size
+}
+
+func NewRoutingTable(myid IDType,config *Config,_checker Checker,rnd *lockedRand) *routingTable{
 
 	ret := &routingTable{
-		k:					_k,
+		config:				config,
+		rand:				rnd,
 		id:					myid,
 		closeEvent: 		make(chan struct{}),
-		timeoutEvent: 		make(chan *node),
+		doneEvent:			make(chan struct{}),
+		closestEvent:		make(chan *closestRequest),
+		snapshotEvent:		make(chan chan [][]node),
+		goodEvent:			make(chan chan []node),
+		resetEvent:			make(chan IDType),
+		pingDoneEvent: 		make(chan pingResult),
 		pingEvent: 			make(chan *node),
-		notifyEvent:		make(chan *node),
-		pingTimers: 		make(map[*node]*time.Timer),
-		timeoutTimers: 		make(map[*node]*time.Timer),
-		failed:				make(map[*node]int),
-		knownNodes:			make(map[IDType]*node),
+		notifyEvent:		make(chan nodeEvent),
+		pingTimers: 		make(map[IDType]Timer),
+		states:				make(map[IDType]*nodeState),
+		verifying:			make(map[IDType]bool),
 		checker:            _checker,
-		file:				"data",
-		bucket:            make([]*Kbucket,keySize),
-	}
-	for i:=0;i<keySize;i++{
-		ret.bucket[i] = newKbucket()
+		bucket:            []*Kbucket{newKbucket(config.Clock.Now())},
 	}
 	go ret.routine()
-	ret.loadFromFile(ret.file)
 	return ret
 }
\ No newline at end of file
@@ -0,0 +1,387 @@
+package dht
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testChecker answers every ping and ignores refreshes.
+type testChecker struct{}
+
+func (testChecker) Ping(*net.UDPAddr) error{
+	return nil
+}
+
+func (testChecker) Refresh(IDType){}
+
+func newTestTable(id IDType,seed int64) *routingTable{
+	config := DefaultConfig().withDefaults()
+	rnd := newLockedRand(rand.NewSource(seed))
+	return NewRoutingTable(id,config,testChecker{},rnd)
+}
+
+func randomID(r *rand.Rand) IDType{
+	var id IDType
+	r.Read(id[:])
+	return id
+}
+
+// nearID returns a random ID sharing the first prefix bits with id.
+func nearID(r *rand.Rand,id IDType,prefix int) IDType{
+	ret := randomID(r)
+	for b := 0; b < prefix && b < keySize; b++{
+		mask := byte(0x80) >> uint(b%8)
+		ret[b/8] = ret[b/8] &^ mask | id[b/8] & mask
+	}
+	return ret
+}
+
+func testNode(r *rand.Rand,id IDType) *node{
+	return &node{id,net.UDPAddr{IP: net.IPv4(10,byte(r.Intn(256)),byte(r.Intn(256)),1),Port: 6881}}
+}
+
+func TestCommonPrefixLen(t *testing.T){
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++{
+		a := randomID(r)
+		want := r.Intn(keySize + 1)
+		b := a
+		if want < keySize{
+			b = nearID(r,a,want)
+			b[want/8] ^= (^(a[want/8] ^ b[want/8])) & (byte(0x80) >> uint(want%8))
+		}
+		if got := commonPrefixLen(&a,&b); got != want{
+			t.Fatalf("commonPrefixLen(%x,%x) = %d, want %d",a,b,got,want)
+		}
+	}
+}
+
+// checkBuckets verifies the invariants of a stopped table: bucket i holds
+// the nodes sharing exactly i leading bits with us, the last bucket those
+// sharing at least as many, and no bucket is over capacity.
+func checkBuckets(t *testing.T,rt *routingTable){
+	t.Helper()
+	last := len(rt.bucket) - 1
+	seen := make(map[IDType]bool)
+	for i,bkt := range rt.bucket{
+		if len(bkt.Entry) > rt.config.K || len(bkt.Candidate) > rt.config.K{
+			t.Errorf("bucket %d has %d entries and %d candidates",i,len(bkt.Entry),len(bkt.Candidate))
+		}
+		for _,o := range append(append([]*node(nil),bkt.Entry...),bkt.Candidate...){
+			cpl := commonPrefixLen(&rt.id,&o.id)
+			if i < last && cpl != i || i == last && cpl < i{
+				t.Errorf("node %x with prefix %d in bucket %d of %d",o.id,cpl,i,last + 1)
+			}
+			if seen[o.id]{
+				t.Errorf("node %x twice in the table",o.id)
+			}
+			seen[o.id] = true
+		}
+		if i < last && len(bkt.Entry) == 0 && len(bkt.Candidate) > 0{
+			t.Errorf("bucket %d has candidates but no entries",i)
+		}
+	}
+}
+
+// TestClosestNodes fills random tables, biased towards our own ID so that
+// the buckets split deep, and checks ClosestNodes against a brute-force
+// sort of the entries by XOR distance.
+func TestClosestNodes(t *testing.T){
+	for seed := int64(1); seed <= 50; seed++{
+		r := rand.New(rand.NewSource(seed))
+		self := randomID(r)
+		rt := newTestTable(self,seed)
+
+		n := 1 + r.Intn(400)
+		for i := 0; i < n; i++{
+			id := randomID(r)
+			if r.Intn(2) == 0{
+				id = nearID(r,self,r.Intn(40))
+			}
+			rt.Notify(testNode(r,id))
+		}
+
+		var entries []IDType
+		for _,bkt := range rt.Snapshot(){
+			for _,o := range bkt{
+				entries = append(entries,o.id)
+			}
+		}
+
+		for q := 0; q < 20; q++{
+			target := randomID(r)
+			if q % 2 == 0{
+				target = nearID(r,self,r.Intn(30))
+			}
+			k := 1 + r.Intn(16)
+
+			want := append([]IDType(nil),entries...)
+			sort.Slice(want,func(i,j int) bool{
+				return closer(&target,&want[i],&want[j]) < 0
+			})
+			if len(want) > k{
+				want = want[:k]
+			}
+
+			got := rt.ClosestNodes(&target,k)
+			if len(got) != len(want){
+				t.Fatalf("seed %d: ClosestNodes returned %d nodes, want %d",seed,len(got),len(want))
+			}
+			for i := range want{
+				if got[i].id != want[i]{
+					t.Fatalf("seed %d: node %d is %x, want %x",seed,i,got[i].id,want[i])
+				}
+			}
+		}
+
+		if size := rt.Size(); size != len(entries){
+			t.Errorf("seed %d: Size() = %d, want %d",seed,size,len(entries))
+		}
+		rt.Stop()
+		checkBuckets(t,rt)
+	}
+}
+
+// TestSplit checks that only the bucket holding our own ID splits: nodes
+// far from us never get more than K entries however many there are.
+func TestSplit(t *testing.T){
+	r := rand.New(rand.NewSource(7))
+	self := randomID(r)
+	rt := newTestTable(self,7)
+
+	// 100 nodes in the far half of the space fill one bucket only.
+	far := self
+	far[0] ^= 0x80
+	for i := 0; i < 100; i++{
+		rt.Notify(testNode(r,nearID(r,far,1)))
+	}
+	// nodes near us make the table split down to them.
+	for i := 0; i < 100; i++{
+		rt.Notify(testNode(r,nearID(r,self,20 + r.Intn(20))))
+	}
+	rt.Stop()
+
+	if len(rt.bucket) < 20{
+		t.Errorf("table has %d buckets, want at least 20",len(rt.bucket))
+	}
+	if n := len(rt.bucket[0].Entry); n != rt.config.K{
+		t.Errorf("far bucket has %d entries, want %d",n,rt.config.K)
+	}
+	checkBuckets(t,rt)
+}
+
+// flakyChecker times out on a share of its pings, cannot send another
+// share, and, like the node, reports the others' answers back to the table.
+type flakyChecker struct {
+	rt		*routingTable
+	rnd		*lockedRand
+}
+
+func (this *flakyChecker) Ping(addr *net.UDPAddr) error{
+	switch this.rnd.intn(4) {
+	case 0:
+		return ErrQueryTimeout
+	case 1:
+		return ErrRateLimited
+	}
+	this.rt.Notify(&node{this.rnd.id(),*addr})
+	return nil
+}
+
+func (this *flakyChecker) Refresh(IDType){}
+
+// TestConcurrentLoad hammers one table from many goroutines at once, with
+// pings timing out and resets under way; run it with -race.
+func TestConcurrentLoad(t *testing.T){
+	config := DefaultConfig().withDefaults()
+	config.PingInterval = 2 * time.Millisecond
+	rnd := newLockedRand(rand.NewSource(1))
+	checker := &flakyChecker{rnd: rnd}
+	rt := NewRoutingTable(randomID(rand.New(rand.NewSource(1))),config,checker,rnd)
+	checker.rt = rt
+
+	const workers,ops = 16,2000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++{
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < ops; i++{
+				id := randomID(r)
+				switch r.Intn(10){
+				case 0,1,2:
+					rt.Notify(testNode(r,id))
+				case 3,4:
+					rt.NotifyQuery(testNode(r,id))
+				case 5:
+					nodes := rt.ClosestNodes(&id,8)
+					for j := 1; j < len(nodes); j++{
+						if closer(&id,&nodes[j-1].id,&nodes[j].id) > 0{
+							t.Errorf("ClosestNodes out of order")
+						}
+					}
+				case 6:
+					rt.Snapshot()
+				case 7:
+					rt.GoodNodes()
+				case 8:
+					rt.Size()
+				case 9:
+					if r.Intn(100) == 0{
+						rt.Reset(id)
+					}
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	time.Sleep(20 * time.Millisecond)
+	rt.Stop()
+	checkBuckets(t,rt)
+
+	// Calls after Stop return at once.
+	rt.Notify(testNode(rand.New(rand.NewSource(2)),IDType{}))
+	if rt.ClosestNodes(&IDType{},8) != nil || rt.Snapshot() != nil{
+		t.Error("stopped table still answers")
+	}
+}
+
+// failingChecker fails every ping with err.
+type failingChecker struct {
+	err		error
+}
+
+func (this failingChecker) Ping(*net.UDPAddr) error{
+	return this.err
+}
+
+func (failingChecker) Refresh(IDType){}
+
+// TestPingNotSent checks that only pings that went out and got no answer
+// count against a node: a ping our own send budget dropped does not.
+func TestPingNotSent(t *testing.T){
+	for _,c := range []struct {
+		err		error
+		evicted	bool
+	}{
+		{ErrQueryTimeout,true},
+		{ErrRateLimited,false},
+		{ErrTooManyTransactions,false},
+		{context.Canceled,false},
+		{&net.OpError{Op: "write",Err: net.ErrClosed},false},
+	}{
+		config := DefaultConfig().withDefaults()
+		config.PingInterval = time.Millisecond
+		config.Logger = log.New(io.Discard,"",0)
+		r := rand.New(rand.NewSource(3))
+		rt := NewRoutingTable(randomID(r),config,failingChecker{c.err},newLockedRand(rand.NewSource(3)))
+		for i := 0; i < config.K; i++{
+			rt.Notify(testNode(r,randomID(r)))
+		}
+		time.Sleep(50 * time.Millisecond)
+		rt.Stop()
+
+		size := 0
+		for _,bkt := range rt.bucket{
+			size += len(bkt.Entry)
+		}
+		if evicted := size < config.K; evicted != c.evicted{
+			t.Errorf("%v: %d of %d entries left",c.err,size,config.K)
+		}
+		if !c.evicted{
+			for id,st := range rt.states{
+				if st.failures != 0{
+					t.Errorf("%v: node %x has %d failures",c.err,id,st.failures)
+				}
+			}
+		}
+	}
+}
+
+// offsetClock is the system clock moved ahead by whatever the test adds.
+type offsetClock struct {
+	systemClock
+	offset		atomic.Int64
+}
+
+func (this *offsetClock) Now() time.Time{
+	return time.Now().Add(time.Duration(this.offset.Load()))
+}
+
+func (this *offsetClock) advance(d time.Duration){
+	this.offset.Add(int64(d))
+}
+
+// recordingChecker fails every ping and records where they went.
+type recordingChecker struct {
+	mu		sync.Mutex
+	pinged	[]string
+}
+
+func (this *recordingChecker) Ping(addr *net.UDPAddr) error{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.pinged = append(this.pinged,addr.String())
+	return ErrQueryTimeout
+}
+
+func (this *recordingChecker) Refresh(IDType){}
+
+// TestSpoofedID checks that a query carrying a known ID from another
+// address does not take over that node's slot.
+func TestSpoofedID(t *testing.T){
+	clock := &offsetClock{}
+	config := DefaultConfig().withDefaults()
+	config.Clock = clock
+	checker := &recordingChecker{}
+	r := rand.New(rand.NewSource(5))
+	rt := NewRoutingTable(randomID(r),config,checker,newLockedRand(rand.NewSource(5)))
+	defer rt.Stop()
+
+	good := &node{randomID(r),net.UDPAddr{IP: net.IPv4(10,0,0,1),Port: 6881}}
+	stale := &node{randomID(r),net.UDPAddr{IP: net.IPv4(10,0,0,2),Port: 6881}}
+	rt.Notify(good)
+	rt.Notify(stale)
+	rt.Snapshot()
+	// Later, only good has answered recently.
+	clock.advance(config.PingInterval + time.Minute)
+	rt.Notify(good)
+
+	spoofer := net.UDPAddr{IP: net.IPv4(192,0,2,66),Port: 4444}
+	rt.NotifyQuery(&node{good.id,spoofer})
+	rt.NotifyQuery(&node{stale.id,spoofer})
+	rt.Snapshot()
+	time.Sleep(20 * time.Millisecond)
+
+	addrs := make(map[IDType]string)
+	for _,bkt := range rt.Snapshot(){
+		for _,o := range bkt{
+			addrs[o.id] = o.addr.String()
+		}
+	}
+	if addrs[good.id] != "10.0.0.1:6881" || addrs[stale.id] != "10.0.0.2:6881"{
+		t.Errorf("entries moved to %v",addrs)
+	}
+	// Only the claim to the questionable node's ID was checked.
+	checker.mu.Lock()
+	if len(checker.pinged) != 1 || checker.pinged[0] != spoofer.String(){
+		t.Errorf("pinged %v, want only %v",checker.pinged,&spoofer)
+	}
+	checker.mu.Unlock()
+
+	// An answer from the new address does move a questionable node.
+	rt.Notify(&node{stale.id,spoofer})
+	nodes := rt.ClosestNodes(&stale.id,1)
+	if len(nodes) != 1 || nodes[0].addr.String() != spoofer.String(){
+		t.Errorf("closest node %v, want %v",nodes,&spoofer)
+	}
+}
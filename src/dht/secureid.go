@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+)
+
+// BEP 42 ties a node ID to the node's external IP: the first 21 bits of
+// the ID are those of a CRC32-C of the masked IP and of a random number r,
+// which is kept in the last byte of the ID.
+
+var (
+	v4Mask			= []byte{0x03,0x0f,0x3f,0xff}
+	v6Mask			= []byte{0x01,0x03,0x07,0x0f,0x1f,0x3f,0x7f,0xff}
+	castagnoli		= crc32.MakeTable(crc32.Castagnoli)
+)
+
+func secureCRC(ip net.IP,r byte) uint32{
+	mask := v6Mask
+	if ip4 := ip.To4(); ip4 != nil{
+		ip,mask = ip4,v4Mask
+	}
+	masked := make([]byte,len(mask))
+	for i := range mask{
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= (r & 0x07) << 5
+	return crc32.Checksum(masked,castagnoli)
+}
+
+// SecureNodeID returns id with its first 21 bits set for ip. The last byte
+// of id is the random number r of BEP 42; the other bits are kept.
+func SecureNodeID(ip net.IP,id IDType) IDType{
+	crc := secureCRC(ip,id[19])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc >> 8) & 0xf8 | id[2] & 0x07
+	return id
+}
+
+// ValidNodeID reports whether id is a BEP 42 ID for ip. Local addresses
+// are exempt and always valid.
+func ValidNodeID(ip net.IP,id IDType) bool{
+	if isLocalIP(ip){
+		return true
+	}
+	want := SecureNodeID(ip,id)
+	return want[0] == id[0] && want[1] == id[1] && want[2] & 0xf8 == id[2] & 0xf8
+}
+
+func isLocalIP(ip net.IP) bool{
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// ID returns our node ID, which changes when our external IP does.
+func (this *DHTNode) ID() IDType{
+	this.idMu.RLock()
+	defer this.idMu.RUnlock()
+	return this.id
+}
+
+// adoptExternalIP replaces a random ID by a BEP 42 ID for ip, our new
+// external IP, and rebuilds the routing tables around it. An ID given to
+// Create or already valid for ip is kept.
+func (this *DHTNode) adoptExternalIP(ip net.IP){
+	if this.fixedID{
+		return
+	}
+	this.idMu.Lock()
+	defer this.idMu.Unlock()
+	if ValidNodeID(ip,this.id){
+		return
+	}
+	this.id = SecureNodeID(ip,this.rand.id())
+	this.logger.Println("new node ID: ",hex.EncodeToString(this.id[:]))
+	this.RT.Reset(this.id)
+	this.RT6.Reset(this.id)
+}
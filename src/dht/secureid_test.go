@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// The examples of BEP 42. Only the first 21 bits and the last byte are
+// defined by the IP and r; the rest is random.
+var secureIDVectors = []struct {
+	ip	string
+	id	string
+}{
+	{"124.31.75.21","5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124","5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170","a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14","1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83","e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func testID(s string) IDType{
+	var id IDType
+	data,err := hex.DecodeString(s)
+	if err != nil || len(data) != len(id){
+		panic("bad test ID " + s)
+	}
+	copy(id[:],data)
+	return id
+}
+
+func TestSecureNodeID(t *testing.T){
+	for _,v := range secureIDVectors{
+		ip,want := net.ParseIP(v.ip),testID(v.id)
+		id := want
+		id[0],id[1],id[2] = 0,0,id[2] & 0x07
+		if got := SecureNodeID(ip,id); got != want{
+			t.Errorf("SecureNodeID(%s) = %x, want %x",v.ip,got,want)
+		}
+	}
+}
+
+func TestValidNodeID(t *testing.T){
+	for _,v := range secureIDVectors{
+		ip,id := net.ParseIP(v.ip),testID(v.id)
+		if !ValidNodeID(ip,id){
+			t.Errorf("%x rejected for %s",id,v.ip)
+		}
+		// The low bits of the third byte are not part of the prefix...
+		id[2] ^= 0x07
+		if !ValidNodeID(ip,id){
+			t.Errorf("%x rejected for %s",id,v.ip)
+		}
+		// ...but its top bits are, and so is r.
+		id[2] ^= 0x08
+		if ValidNodeID(ip,id){
+			t.Errorf("%x accepted for %s",id,v.ip)
+		}
+		id = testID(v.id)
+		id[19]++
+		if ValidNodeID(ip,id){
+			t.Errorf("%x accepted for %s",id,v.ip)
+		}
+	}
+	if ValidNodeID(net.ParseIP("124.31.75.22"),testID(secureIDVectors[0].id)){
+		t.Error("ID accepted for another IP")
+	}
+}
+
+func TestValidNodeIDLocal(t *testing.T){
+	id := testID(secureIDVectors[0].id)
+	id[0] ^= 0xff
+	for _,s := range []string{"10.1.2.3","172.16.0.1","192.168.1.1","127.0.0.1","169.254.1.1","0.0.0.0","::1","fe80::1","fd00::1"}{
+		if !isLocalIP(net.ParseIP(s)){
+			t.Errorf("%s is not local",s)
+		}
+		if !ValidNodeID(net.ParseIP(s),id){
+			t.Errorf("%x rejected for local %s",id,s)
+		}
+	}
+	for _,s := range []string{"124.31.75.21","2001:db8::1"}{
+		if isLocalIP(net.ParseIP(s)){
+			t.Errorf("%s is local",s)
+		}
+		if ValidNodeID(net.ParseIP(s),id){
+			t.Errorf("%x accepted for %s",id,s)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tokenRotation	= 5 * time.Minute
+	tokenSize		= 8
+)
+
+// tokenManager hands out announce tokens as in BEP 5: an HMAC of the
+// requester's IP under a secret that changes every tokenRotation. Tokens made
+// with the current or the previous secret are accepted.
+type tokenManager struct {
+	mu			sync.Mutex
+	secret		[]byte
+	previous	[]byte
+	rotated		time.Time
+	clock		Clock
+}
+
+func newTokenManager(clock Clock) *tokenManager{
+	return &tokenManager{
+		secret:		newSecret(),
+		previous:	newSecret(),
+		rotated:	clock.Now(),
+		clock:		clock,
+	}
+}
+
+func newSecret() []byte{
+	secret := make([]byte,20)
+	rand.Read(secret)
+	return secret
+}
+
+// secrets rotates the secret if it is due and returns the current and the
+// previous one.
+func (this *tokenManager) secrets() ([]byte,[]byte){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for this.clock.Now().Sub(this.rotated) >= tokenRotation{
+		this.previous = this.secret
+		this.secret = newSecret()
+		this.rotated = this.rotated.Add(tokenRotation)
+	}
+	return this.secret,this.previous
+}
+
+func makeToken(secret []byte,ip net.IP) []byte{
+	if ip4 := ip.To4(); ip4 != nil{
+		ip = ip4
+	}
+	mac := hmac.New(sha1.New,secret)
+	mac.Write(ip)
+	return mac.Sum(nil)[:tokenSize]
+}
+
+// generate returns the token for ip.
+func (this *tokenManager) generate(ip net.IP) string{
+	secret,_ := this.secrets()
+	return string(makeToken(secret,ip))
+}
+
+// validate reports whether token was handed out to ip recently.
+func (this *tokenManager) validate(ip net.IP,token string) bool{
+	secret,previous := this.secrets()
+	return hmac.Equal([]byte(token),makeToken(secret,ip)) ||
+		hmac.Equal([]byte(token),makeToken(previous,ip))
+}
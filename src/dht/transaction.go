@@ -1 +1,151 @@
 package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrQueryTimeout = errors.New("query timeout")
+	ErrTooManyTransactions = errors.New("too many outstanding transactions")
+)
+
+// transactionKey identifies an outstanding query. Transaction IDs are only
+// unique per remote node, so the address is part of the key.
+type transactionKey struct {
+	id		string
+	addr	string
+}
+
+type transaction struct {
+	key			transactionKey
+	response	chan *KRPCMessage
+}
+
+// maxTransactionDraws bounds the random IDs register tries before deciding
+// that too many queries to one node are outstanding.
+const maxTransactionDraws = 64
+
+// transactionManager hands out transaction IDs and matches replies to the
+// queries waiting for them.
+type transactionManager struct {
+	mu			sync.Mutex
+	rnd			*lockedRand
+	pending		map[transactionKey]*transaction
+}
+
+func newTransactionManager(rnd *lockedRand) *transactionManager{
+	return &transactionManager{
+		rnd:		rnd,
+		pending:	make(map[transactionKey]*transaction),
+	}
+}
+
+// register allocates a transaction ID not in use for addr. IDs are drawn at
+// random, so that an off-path attacker cannot guess the ID of a pending
+// query and answer it first.
+func (this *transactionManager) register(addr *net.UDPAddr) (*transaction,error){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var id [2]byte
+	for i := 0; i < maxTransactionDraws; i++{
+		binary.BigEndian.PutUint16(id[:],uint16(this.rnd.intn(1 << 16)))
+
+		key := transactionKey{string(id[:]),addr.String()}
+		if _,ok := this.pending[key]; !ok{
+			t := &transaction{
+				key:		key,
+				response:	make(chan *KRPCMessage,1),
+			}
+			this.pending[key] = t
+			return t,nil
+		}
+	}
+	return nil,ErrTooManyTransactions
+}
+
+// release frees the transaction ID for reuse.
+func (this *transactionManager) release(t *transaction){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.pending,t.key)
+}
+
+// deliver hands a response or error message to the query waiting for it and
+// reports whether there was one.
+func (this *transactionManager) deliver(addr *net.UDPAddr,msg *KRPCMessage) bool{
+	this.mu.Lock()
+	t,ok := this.pending[transactionKey{msg.T,addr.String()}]
+	if ok{
+		delete(this.pending,t.key)
+	}
+	this.mu.Unlock()
+
+	if ok{
+		t.response <- msg
+	}
+	return ok
+}
+
+// Query sends q to addr and waits for the answer, resending it up to
+// QueryRetries times when no answer comes within QueryTimeout.
+// The transaction ID is filled in, and so is the querying node's ID unless
+// q already carries one. A KRPC error
+// reply is returned as an *ErrorType.
+func (this *DHTNode) Query(ctx context.Context,addr *net.UDPAddr,q *KRPCQuery) (*KRPCResponse,error){
+	t,err := this.transactions.register(addr)
+	if err != nil{
+		return nil,err
+	}
+	defer this.transactions.release(t)
+
+	q.transactionID = []byte(t.key.id)
+	if q.id == (IDType{}){
+		q.id = this.ID()
+	}
+	data,err := q.Encode()
+	if err != nil{
+		return nil,err
+	}
+
+	for attempt := 0; ; attempt++{
+		if err := this.writeToUDP(addr,data,q.Type); err != nil{
+			return nil,err
+		}
+		timeout,timer := after(this.config.Clock,this.config.QueryTimeout)
+
+		select {
+		case msg := <-t.response:
+			timer.Stop()
+			if msg.isError(){
+				if msg.E == nil{
+					return nil,KRPCErrProtocol
+				}
+				return nil,msg.E
+			}
+			R := &KRPCResponse{Type: q.Type}
+			if err := R.LoadFromMessage(msg); err != nil{
+				return nil,err
+			}
+			this.table(addr).Notify(&node{
+				R.queryID,
+				*addr,
+			})
+			if R.ip != nil{
+				this.learnExternalAddr(R.ip,addr)
+			}
+			return R,nil
+		case <-timeout:
+			if attempt >= this.config.QueryRetries{
+				return nil,ErrQueryTimeout
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			return nil,ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package dht
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTransactionIDs(t *testing.T){
+	m := newTransactionManager(newLockedRand(rand.NewSource(1)))
+	addr := testAddr("192.0.2.1:6881")
+
+	// Enough queries that some draws collide and are redrawn.
+	const n = 4096
+	seen := make(map[string]bool)
+	sequential := 0
+	var prev string
+	for i := 0; i < n; i++{
+		tr,err := m.register(addr)
+		if err != nil{
+			t.Fatalf("query %d: %v",i,err)
+		}
+		if seen[tr.key.id]{
+			t.Fatalf("query %d: ID %x handed out twice",i,tr.key.id)
+		}
+		seen[tr.key.id] = true
+		if prev != "" && tr.key.id[0] == prev[0] && tr.key.id[1] == prev[1] + 1{
+			sequential++
+		}
+		prev = tr.key.id
+	}
+	if sequential > n / 100{
+		t.Errorf("%d of %d IDs follow the previous one",sequential,n)
+	}
+
+	// Another node has its own ID space.
+	if _,err := m.register(testAddr("192.0.2.2:6881")); err != nil{
+		t.Fatal(err)
+	}
+	if len(m.pending) != n + 1{
+		t.Errorf("%d pending transactions, want %d",len(m.pending),n + 1)
+	}
+}
@@ -0,0 +1,120 @@
+package dhttest
+
+import (
+	"dht"
+	"sync"
+	"time"
+)
+
+// Clock is a virtual dht.Clock: time only moves when Advance is called,
+// which fires the timers and tickers that fall due on the way.
+type Clock struct {
+	mu			sync.Mutex
+	now			time.Time
+	timers		[]*timer
+}
+
+func NewClock(start time.Time) *Clock{
+	return &Clock{now: start}
+}
+
+type timer struct {
+	clock		*Clock
+	when		time.Time
+	period		time.Duration	// 0 for a one-shot timer
+	f			func(now time.Time)
+}
+
+func (this *Clock) Now() time.Time{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.now
+}
+
+// AfterFunc calls f once the clock has advanced by d. Unlike time.AfterFunc,
+// f runs on the goroutine calling Advance, so timers fire in order; it must
+// not wait for anything that needs the clock to move.
+func (this *Clock) AfterFunc(d time.Duration,f func()) dht.Timer{
+	return this.add(d,0,func(time.Time) {
+		f()
+	})
+}
+
+// NewTicker ticks every d of virtual time. Like time.Ticker it drops ticks
+// for a slow receiver.
+func (this *Clock) NewTicker(d time.Duration) dht.Ticker{
+	ch := make(chan time.Time,1)
+	t := this.add(d,d,func(now time.Time) {
+		select {
+		case ch <- now:
+		default:
+		}
+	})
+	return &ticker{t,ch}
+}
+
+func (this *Clock) add(d,period time.Duration,f func(time.Time)) *timer{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	t := &timer{clock: this,when: this.now.Add(d),period: period,f: f}
+	this.timers = append(this.timers,t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing due timers in order.
+func (this *Clock) Advance(d time.Duration){
+	this.mu.Lock()
+	end := this.now.Add(d)
+	for{
+		var next *timer
+		for _,t := range this.timers{
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)){
+				next = t
+			}
+		}
+		if next == nil{
+			break
+		}
+		this.now = next.when
+		if next.period > 0{
+			next.when = next.when.Add(next.period)
+		}else{
+			this.remove(next)
+		}
+		now := this.now
+		this.mu.Unlock()
+		next.f(now)
+		this.mu.Lock()
+	}
+	this.now = end
+	this.mu.Unlock()
+}
+
+func (this *Clock) remove(t *timer) bool{
+	for i,o := range this.timers{
+		if o == t{
+			this.timers = append(this.timers[:i],this.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (this *timer) Stop() bool{
+	this.clock.mu.Lock()
+	defer this.clock.mu.Unlock()
+	return this.clock.remove(this)
+}
+
+type ticker struct {
+	*timer
+	ch			chan time.Time
+}
+
+func (this *ticker) Chan() <-chan time.Time{
+	return this.ch
+}
+
+func (this *ticker) Stop(){
+	this.timer.Stop()
+}
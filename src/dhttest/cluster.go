@@ -0,0 +1,165 @@
+package dhttest
+
+import (
+	"context"
+	"dht"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"testing/synctest"
+	"time"
+)
+
+// Announce is an announce_peer received by a node of a Cluster.
+type Announce struct {
+	Node		int
+	IP			string
+	Port		int
+	InfoHash	string
+	PeerID		string
+	Verified	bool
+}
+
+// defaultStep is how far Run advances the clock at a time.
+const defaultStep = 10 * time.Millisecond
+
+// Cluster is a set of nodes wired through one Network and driven by its
+// Clock. The nodes only see time pass in Run and RunUntil.
+//
+// A Cluster must be created and run inside a synctest bubble (see
+// synctest.Test), which lets it wait for the nodes to finish handling what
+// arrived instead of guessing in real time.
+type Cluster struct {
+	Network		*Network
+	Clock		*Clock
+	Nodes		[]*dht.DHTNode
+	Addrs		[]*net.UDPAddr
+	Step		time.Duration	// how far the clock moves between settling; replies take at least one step
+
+	mu			sync.Mutex
+	announces	[]Announce
+}
+
+// NewCluster starts n nodes on network, the i-th at 10.0.0.0 + i + 1 port
+// 6881. Node 0 is the bootstrap router of the others. Node IDs derive from
+// the seed of network, and the nodes send and accept packets without rate
+// limits. configure, if not nil, adjusts the Config of each node before it
+// is created.
+func NewCluster(ctx context.Context,network *Network,n int,configure func(i int,config *dht.Config)) (*Cluster,error){
+	ret := &Cluster{
+		Network:	network,
+		Clock:		network.Clock(),
+		Step:		defaultStep,
+	}
+	for i := 0; i < n; i++{
+		ip := uint32(10) << 24 + uint32(i) + 1
+		ret.Addrs = append(ret.Addrs,&net.UDPAddr{
+			IP:		net.IPv4(byte(ip >> 24),byte(ip >> 16),byte(ip >> 8),byte(ip)),
+			Port:	6881,
+		})
+	}
+
+	for i := 0; i < n; i++{
+		config := dht.DefaultConfig()
+		config.BootstrapNodes = []string{ret.Addrs[0].String()}
+		if i == 0{
+			config.BootstrapNodes = nil
+		}
+		config.StateFile = ""
+		config.Logger = log.New(io.Discard,"",0)
+		config.Rand = rand.NewSource(network.seed())
+		config.Clock = ret.Clock
+		config.Listen = ret.Network.Listen
+		config.MaxPacketRate = -1
+		config.SendRates = map[string]float64{}
+		config.MaxPacketsPerIP = -1
+		if configure != nil{
+			configure(i,config)
+		}
+
+		node := dht.NewNode(config)
+		node.Create("random",ret.Addrs[i].String(),ret.peerHandler(i))
+		if err := node.Start(ctx); err != nil{
+			_ = ret.Shutdown(ctx)
+			return nil,err
+		}
+		ret.Nodes = append(ret.Nodes,node)
+	}
+	return ret,nil
+}
+
+func (this *Cluster) peerHandler(i int) func(string,int,string,string,bool){
+	return func(ip string,port int,infoHash,peerID string,verified bool) {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		this.announces = append(this.announces,Announce{i,ip,port,infoHash,peerID,verified})
+	}
+}
+
+// Run advances the clock by d, one Step at a time, and lets the nodes
+// handle what arrives after each step.
+func (this *Cluster) Run(d time.Duration){
+	this.settle()
+	for d > 0{
+		step := this.Step
+		if step > d{
+			step = d
+		}
+		this.Clock.Advance(step)
+		this.settle()
+		d -= step
+	}
+}
+
+// RunUntil runs the cluster until done is closed or limit has passed on
+// the clock, and reports whether done was closed.
+func (this *Cluster) RunUntil(done <-chan struct{},limit time.Duration) bool{
+	this.settle()
+	for elapsed := time.Duration(0); ; elapsed += this.Step{
+		select {
+		case <-done:
+			return true
+		default:
+		}
+		if elapsed >= limit{
+			return false
+		}
+		this.Clock.Advance(this.Step)
+		this.settle()
+	}
+}
+
+// settle waits until every goroutine of the bubble is blocked, the nodes
+// waiting for packets or for the clock.
+func (this *Cluster) settle(){
+	synctest.Wait()
+}
+
+// Announces returns the announces received so far by all nodes.
+func (this *Cluster) Announces() []Announce{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]Announce(nil),this.announces...)
+}
+
+// Shutdown shuts all nodes down at once and returns the first error.
+func (this *Cluster) Shutdown(ctx context.Context) error{
+	errs := make([]error,len(this.Nodes))
+	var wg sync.WaitGroup
+	for i,node := range this.Nodes{
+		wg.Add(1)
+		go func(i int,node *dht.DHTNode) {
+			defer wg.Done()
+			errs[i] = node.Shutdown(ctx)
+		}(i,node)
+	}
+	wg.Wait()
+	for _,err := range errs{
+		if err != nil{
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package dhttest
+
+import (
+	"bencode"
+	"context"
+	"dht"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func newTestCluster(t *testing.T,n int,configure func(i int,config *dht.Config)) *Cluster{
+	t.Helper()
+	network := NewNetwork(1)
+	network.SetLatency(5 * time.Millisecond,5 * time.Millisecond)
+	c,err := NewCluster(context.Background(),network,n,configure)
+	if err != nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx,cancel := context.WithTimeout(context.Background(),10 * time.Second)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil{
+			t.Error("Shutdown: ",err)
+		}
+	})
+	return c
+}
+
+// closest returns the k IDs of ids closest to target, nearest first.
+func closest(ids []dht.IDType,target dht.IDType,k int) []dht.IDType{
+	ret := append([]dht.IDType(nil),ids...)
+	sort.Slice(ret,func(i,j int) bool{
+		for b := range target{
+			x,y := ret[i][b] ^ target[b],ret[j][b] ^ target[b]
+			if x != y{
+				return x < y
+			}
+		}
+		return false
+	})
+	if len(ret) > k{
+		ret = ret[:k]
+	}
+	return ret
+}
+
+func (this *Cluster) ids(skip int) []dht.IDType{
+	var ret []dht.IDType
+	for i,node := range this.Nodes{
+		if i != skip{
+			ret = append(ret,node.ID())
+		}
+	}
+	return ret
+}
+
+func TestBootstrap(t *testing.T){
+	synctest.Test(t,func(t *testing.T) {
+		c := newTestCluster(t,30,nil)
+		c.Run(20 * time.Second)
+
+		for i,node := range c.Nodes{
+			if n := len(node.Nodes()); n < 8{
+				t.Errorf("node %d knows %d nodes, want at least 8",i,n)
+			}
+		}
+		if sent,_ := c.Network.Stats(); sent == 0{
+			t.Error("no packets sent")
+		}
+	})
+}
+
+func TestLookupNodes(t *testing.T){
+	synctest.Test(t,func(t *testing.T) {
+		c := newTestCluster(t,30,nil)
+		c.Run(20 * time.Second)
+
+		for _,pair := range [][2]int{{3,17},{29,1},{12,26}}{
+			from,to := pair[0],pair[1]
+			target := c.Nodes[to].ID()
+			var nodes []dht.CompactNodeInfo
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				nodes,err = c.Nodes[from].LookupNodes(context.Background(),target)
+			}()
+			if !c.RunUntil(done,30 * time.Second){
+				t.Fatalf("lookup %d -> %d did not finish",from,to)
+			}
+			if err != nil{
+				t.Fatalf("lookup %d -> %d: %v",from,to,err)
+			}
+
+			want := closest(c.ids(from),target,8)
+			if len(nodes) != len(want){
+				t.Fatalf("lookup %d -> %d found %d nodes, want %d",from,to,len(nodes),len(want))
+			}
+			for i := range want{
+				if nodes[i].ID != want[i]{
+					t.Errorf("lookup %d -> %d: node %d is %x, want %x",from,to,i,nodes[i].ID,want[i])
+				}
+			}
+			if !nodes[0].Addr.IP.Equal(c.Addrs[to].IP){
+				t.Errorf("lookup %d -> %d ended at %v",from,to,&nodes[0].Addr)
+			}
+		}
+	})
+}
+
+func TestEviction(t *testing.T){
+	synctest.Test(t,func(t *testing.T) {
+		c := newTestCluster(t,20,func(i int,config *dht.Config) {
+			config.PingInterval = 1 * time.Minute
+		})
+		c.Step = 50 * time.Millisecond
+		c.Run(20 * time.Second)
+
+		dead := map[string]bool{}
+		for _,i := range []int{4,9,15}{
+			dead[c.Addrs[i].String()] = true
+			if err := c.Nodes[i].Shutdown(context.Background()); err != nil{
+				t.Fatal(err)
+			}
+		}
+		c.Run(4 * time.Minute)
+
+		for i,node := range c.Nodes{
+			if dead[c.Addrs[i].String()]{
+				continue
+			}
+			for _,o := range node.Nodes(){
+				if dead[o.Addr.String()]{
+					t.Errorf("node %d still has dead node %v",i,&o.Addr)
+				}
+			}
+			if len(node.Nodes()) == 0{
+				t.Errorf("node %d lost all its nodes",i)
+			}
+		}
+	})
+}
+
+// testPeer is a BitTorrent client on the network that talks KRPC by hand.
+type testPeer struct {
+	c		*Cluster
+	conn	dht.PacketConn
+}
+
+func newTestPeer(t *testing.T,c *Cluster,addr string) *testPeer{
+	t.Helper()
+	laddr,err := net.ResolveUDPAddr("udp",addr)
+	if err != nil{
+		t.Fatal(err)
+	}
+	conn,err := c.Network.Listen("udp4",laddr)
+	if err != nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return &testPeer{c,conn}
+}
+
+// krpcReply is the part of a reply the tests look at.
+type krpcReply struct {
+	T	string	`bencode:"t"`
+	Y	string	`bencode:"y"`
+	R	struct {
+		Token	string	`bencode:"token"`
+	}	`bencode:"r"`
+}
+
+// query sends a query to addr and returns the reply.
+func (this *testPeer) query(t *testing.T,addr *net.UDPAddr,method string,args map[string]interface{}) *krpcReply{
+	t.Helper()
+	data,err := bencode.Marshal(map[string]interface{}{
+		"t":	"aa",
+		"y":	"q",
+		"q":	method,
+		"a":	args,
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	if _,err := this.conn.WriteToUDP(data,addr); err != nil{
+		t.Fatal(err)
+	}
+
+	// Queries from the nodes, such as pings checking on us, go unanswered.
+	var reply *krpcReply
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte,2048)
+		for{
+			n,_,err := this.conn.ReadFromUDP(buf)
+			if err != nil{
+				return
+			}
+			msg := new(krpcReply)
+			if bencode.Unmarshal(buf[:n],msg) == nil && msg.T == "aa" && msg.Y != "q"{
+				reply = msg
+				return
+			}
+		}
+	}()
+	if !this.c.RunUntil(done,10 * time.Second) || reply == nil{
+		t.Fatalf("no reply to %s from %v",method,addr)
+	}
+	return reply
+}
+
+func TestAnnounceHarvest(t *testing.T){
+	synctest.Test(t,func(t *testing.T) {
+		c := newTestCluster(t,30,nil)
+		c.Run(20 * time.Second)
+
+		var infohash dht.IDType
+		rand.New(rand.NewSource(2)).Read(infohash[:])
+		peer := newTestPeer(t,c,"10.0.1.1:6881")
+		peerID := "-TT0001-000000000000"
+
+		// Announce to the nodes closest to the infohash, as a client would.
+		targets := closest(c.ids(-1),infohash,8)
+		for i,node := range c.Nodes{
+			id := node.ID()
+			near := false
+			for _,o := range targets{
+				near = near || o == id
+			}
+			if !near{
+				continue
+			}
+			r := peer.query(t,c.Addrs[i],"get_peers",map[string]interface{}{
+				"id":			peerID,
+				"info_hash":	string(infohash[:]),
+			})
+			token := r.R.Token
+			if r.Y != "r" || token == ""{
+				t.Fatalf("node %d gave no token",i)
+			}
+			r = peer.query(t,c.Addrs[i],"announce_peer",map[string]interface{}{
+				"id":			peerID,
+				"info_hash":	string(infohash[:]),
+				"port":			51413,
+				"token":		token,
+			})
+			if r.Y != "r"{
+				t.Fatalf("node %d refused the announce",i)
+			}
+		}
+
+		// A forged token is reported but not stored.
+		if r := peer.query(t,c.Addrs[0],"announce_peer",map[string]interface{}{
+			"id":			peerID,
+			"info_hash":	string(infohash[:]),
+			"port":			6000,
+			"token":		"forged",
+		}); r.Y != "e"{
+			t.Error("announce with a forged token was accepted")
+		}
+
+		verified,forged := 0,0
+		for _,a := range c.Announces(){
+			if a.InfoHash != hex.EncodeToString(infohash[:]) || a.IP != "10.0.1.1"{
+				t.Errorf("unexpected announce %+v",a)
+				continue
+			}
+			switch {
+			case a.Verified && a.Port == 51413:
+				verified++
+			case !a.Verified && a.Port == 6000:
+				forged++
+			default:
+				t.Errorf("unexpected announce %+v",a)
+			}
+		}
+		if verified != len(targets) || forged != 1{
+			t.Errorf("got %d verified and %d forged announces, want %d and 1",verified,forged,len(targets))
+		}
+
+		// Any node can now find the peer.
+		var peers []*net.TCPAddr
+		var err error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			peers,_,err = c.Nodes[21].LookupPeers(context.Background(),infohash)
+		}()
+		if !c.RunUntil(done,30 * time.Second){
+			t.Fatal("LookupPeers did not finish")
+		}
+		if err != nil{
+			t.Fatal(err)
+		}
+		want := &net.TCPAddr{IP: net.IPv4(10,0,1,1),Port: 51413}
+		found := false
+		for _,p := range peers{
+			found = found || p.IP.Equal(want.IP) && p.Port == want.Port
+			if p.Port == 6000{
+				t.Errorf("forged announce was stored: %v",p)
+			}
+		}
+		if !found{
+			t.Errorf("LookupPeers found %v, want %v",peers,want)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package dhttest
+
+import (
+	"dht"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// inboxSize is how many packets wait for a reader before more are dropped,
+// as a full socket buffer would.
+const inboxSize = 1024
+
+// firstPort is the first port handed out to sockets bound to port 0.
+const firstPort = 40000
+
+// Network is an in-memory UDP network. A packet is delivered after the
+// latency plus a random part of the jitter, so packets can overtake each
+// other, and is lost with the loss probability. Time is that of the
+// network's virtual Clock: packets in flight only arrive as it advances.
+// The random choices are drawn from the seed given to NewNetwork.
+type Network struct {
+	clock		*Clock
+
+	mu			sync.Mutex
+	latency		time.Duration
+	jitter		time.Duration
+	loss		float64
+	rand		*rand.Rand
+	conns		map[string]*conn
+	nextPort	int
+	sent		int
+	dropped		int
+}
+
+func NewNetwork(seed int64) *Network{
+	return &Network{
+		clock:		NewClock(time.Unix(0,0)),
+		rand:		rand.New(rand.NewSource(seed)),
+		conns:		make(map[string]*conn),
+		nextPort:	firstPort,
+	}
+}
+
+// Clock returns the virtual clock of the network.
+func (this *Network) Clock() *Clock{
+	return this.clock
+}
+
+// SetLatency sets the delay of every packet to latency plus a random
+// duration below jitter.
+func (this *Network) SetLatency(latency,jitter time.Duration){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.latency,this.jitter = latency,jitter
+}
+
+// SetLoss sets the probability that a packet is lost.
+func (this *Network) SetLoss(loss float64){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.loss = loss
+}
+
+// seed draws a seed for a node of the network.
+func (this *Network) seed() int64{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.rand.Int63()
+}
+
+// Listen opens a socket on laddr, which must have an IP of the family of
+// network. It can be used as dht.Config.Listen.
+func (this *Network) Listen(network string,laddr *net.UDPAddr) (dht.PacketConn,error){
+	if laddr.IP == nil || laddr.IP.IsUnspecified(){
+		return nil,errors.New("dhttest: listen needs a specific IP")
+	}
+	if (network == "udp4") != (laddr.IP.To4() != nil){
+		return nil,errors.New("dhttest: address does not match " + network)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	addr := *laddr
+	if addr.Port == 0{
+		addr.Port = this.nextPort
+		this.nextPort++
+	}
+	if _,ok := this.conns[addr.String()]; ok{
+		return nil,errors.New("dhttest: address in use: " + addr.String())
+	}
+	c := &conn{
+		network:	this,
+		addr:		&addr,
+		inbox:		make(chan packet,inboxSize),
+		closed:		make(chan struct{}),
+	}
+	this.conns[addr.String()] = c
+	return c,nil
+}
+
+// Stats returns the number of packets sent and how many of them were lost.
+func (this *Network) Stats() (sent,dropped int){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.sent,this.dropped
+}
+
+func (this *Network) send(p packet,to *net.UDPAddr){
+	this.mu.Lock()
+	this.sent++
+	dst,ok := this.conns[to.String()]
+	if !ok || this.rand.Float64() < this.loss{
+		this.dropped++
+		this.mu.Unlock()
+		return
+	}
+	delay := this.latency
+	if this.jitter > 0{
+		delay += time.Duration(this.rand.Int63n(int64(this.jitter)))
+	}
+	this.mu.Unlock()
+
+	if delay <= 0{
+		dst.deliver(p)
+		return
+	}
+	this.clock.add(delay,0,func(time.Time) {
+		dst.deliver(p)
+	})
+}
+
+func (this *Network) remove(c *conn){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.conns[c.addr.String()] == c{
+		delete(this.conns,c.addr.String())
+	}
+}
+
+type packet struct {
+	data	[]byte
+	from	*net.UDPAddr
+}
+
+// conn is a socket of a Network.
+type conn struct {
+	network		*Network
+	addr		*net.UDPAddr
+	inbox		chan packet
+	closeOnce	sync.Once
+	closed		chan struct{}
+}
+
+func (this *conn) ReadFromUDP(b []byte) (int,*net.UDPAddr,error){
+	select {
+	case p := <-this.inbox:
+		return copy(b,p.data),p.from,nil
+	case <-this.closed:
+		return 0,nil,net.ErrClosed
+	}
+}
+
+func (this *conn) WriteToUDP(b []byte,addr *net.UDPAddr) (int,error){
+	select {
+	case <-this.closed:
+		return 0,net.ErrClosed
+	default:
+	}
+	data := make([]byte,len(b))
+	copy(data,b)
+	from := *this.addr
+	this.network.send(packet{data,&from},addr)
+	return len(b),nil
+}
+
+func (this *conn) deliver(p packet){
+	select {
+	case <-this.closed:
+	case this.inbox <- p:
+	default:
+		this.network.mu.Lock()
+		this.network.dropped++
+		this.network.mu.Unlock()
+	}
+}
+
+func (this *conn) SetWriteDeadline(t time.Time) error{
+	return nil
+}
+
+func (this *conn) LocalAddr() net.Addr{
+	return this.addr
+}
+
+func (this *conn) Close() error{
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.network.remove(this)
+	})
+	return nil
+}
@@ -1,29 +1,77 @@
-
 package main
 
 import (
 	"collect"
+	"context"
 	"dht"
+	"flag"
+	"log"
+	"nat"
+	"os"
+	"os/signal"
+	"time"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+	natTimeout = 5 * time.Second
 )
 
 var (
-	dhtnode = dht.NewNode()
+	mapPort = flag.Bool("nat",false,"map the DHT port on the router with NAT-PMP or UPnP")
 	collector = collect.NewCollector()
 )
 
-func handlePeer(ip string,port int,infohash,peerid string){
+func handlePeer(ip string,port int,infohash,peerid string,verified bool){
+	if !verified{
+		return
+	}
 	if err := collector.Get(&collect.Request{
 			IP: 		ip,
 			Port:		port,
 			InfoHash:	infohash,
 			PeerID:		peerid,
 		});err != nil {
-		panic(err)
+		log.Println("collector: ",err)
 	}
 }
 
 func main(){
-	defer collector.Stop()
+	flag.Parse()
+	ctx,stop := signal.NotifyContext(context.Background(),os.Interrupt)
+	defer stop()
+
+	config := dht.DefaultConfig()
+	if *mapPort{
+		natCtx,cancel := context.WithTimeout(ctx,natTimeout)
+		mapper,err := nat.Discover(natCtx)
+		cancel()
+		if err != nil{
+			log.Println("nat: ",err)
+		}else{
+			config.PortMapper = mapper
+		}
+	}
+	dhtnode := dht.NewNode(config)
+
+	if err := collector.Start(ctx); err != nil{
+		log.Fatal(err)
+	}
 	dhtnode.Create("random","0.0.0.0:8666",handlePeer)
-	dhtnode.Run()
-}
\ No newline at end of file
+	if err := dhtnode.Start(ctx); err != nil{
+		log.Fatal(err)
+	}
+	log.Println("Join the DHT network...")
+
+	<-ctx.Done()
+	log.Println("Quit...")
+
+	shutdownCtx,cancel := context.WithTimeout(context.Background(),shutdownTimeout)
+	defer cancel()
+	if err := dhtnode.Shutdown(shutdownCtx); err != nil{
+		log.Println("dht: ",err)
+	}
+	if err := collector.Shutdown(shutdownCtx); err != nil{
+		log.Println("collector: ",err)
+	}
+}
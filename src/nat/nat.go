@@ -0,0 +1,75 @@
+// Package nat opens ports on a home router, with NAT-PMP (RFC 6886) or
+// UPnP-IGD, so that a node behind it can be reached from outside.
+package nat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const natpmpProbeTimeout = 2 * time.Second
+
+var ErrNoGateway = errors.New("nat: no gateway found")
+
+// Mapper opens ports on a NAT gateway. protocol is "udp" or "tcp".
+type Mapper interface {
+	// ExternalIP returns the gateway's external address.
+	ExternalIP(ctx context.Context) (net.IP,error)
+	// AddMapping forwards externalPort to internalPort of this host for
+	// lifetime, and returns the external port actually mapped.
+	AddMapping(ctx context.Context,protocol string,internalPort,externalPort int,lifetime time.Duration) (int,error)
+	DeleteMapping(ctx context.Context,protocol string,internalPort,externalPort int) error
+}
+
+// Discover finds the gateway of this host: NAT-PMP at the default gateway
+// is tried first, then UPnP-IGD by SSDP search.
+func Discover(ctx context.Context) (Mapper,error){
+	if gw,err := DefaultGateway(); err == nil{
+		pmp := NewNATPMP(&net.UDPAddr{IP: gw,Port: NATPMPPort})
+		probeCtx,cancel := context.WithTimeout(ctx,natpmpProbeTimeout)
+		_,err := pmp.ExternalIP(probeCtx)
+		cancel()
+		if err == nil{
+			return pmp,nil
+		}
+	}
+	u,err := DiscoverUPnP(ctx,"")
+	if err != nil{
+		return nil,err
+	}
+	return u,nil
+}
+
+// DefaultGateway returns the IPv4 default gateway, read from the Linux
+// routing table.
+func DefaultGateway() (net.IP,error){
+	f,err := os.Open("/proc/net/route")
+	if err != nil{
+		return nil,err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan(){
+		// Iface Destination Gateway Flags ..., addresses in little-endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000"{
+			continue
+		}
+		v,err := strconv.ParseUint(fields[2],16,32)
+		if err != nil || v == 0{
+			continue
+		}
+		return net.IPv4(byte(v),byte(v >> 8),byte(v >> 16),byte(v >> 24)),nil
+	}
+	if err := scanner.Err(); err != nil{
+		return nil,err
+	}
+	return nil,ErrNoGateway
+}
@@ -0,0 +1,158 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NATPMPPort is where gateways listen for NAT-PMP requests.
+const NATPMPPort = 5351
+
+const (
+	natpmpRetries		= 9
+	natpmpFirstWait		= 250 * time.Millisecond
+
+	natpmpOpExternalIP	= 0
+	natpmpOpMapUDP		= 1
+	natpmpOpMapTCP		= 2
+)
+
+var errNATPMPTimeout = errors.New("nat-pmp: no response from gateway")
+
+// NATPMPError is a result code other than success from the gateway.
+type NATPMPError struct {
+	Code	int
+}
+
+func (this *NATPMPError) Error() string{
+	switch this.Code {
+	case 1:
+		return "nat-pmp: unsupported version"
+	case 2:
+		return "nat-pmp: not authorized"
+	case 3:
+		return "nat-pmp: network failure"
+	case 4:
+		return "nat-pmp: out of resources"
+	case 5:
+		return "nat-pmp: unsupported opcode"
+	}
+	return fmt.Sprintf("nat-pmp: result code %d",this.Code)
+}
+
+// NATPMP is a gateway speaking NAT-PMP.
+type NATPMP struct {
+	gateway		*net.UDPAddr
+	mu			sync.Mutex	// one request at a time: replies carry no transaction ID
+}
+
+func NewNATPMP(gateway *net.UDPAddr) *NATPMP{
+	return &NATPMP{gateway: gateway}
+}
+
+func (this *NATPMP) ExternalIP(ctx context.Context) (net.IP,error){
+	reply,err := this.request(ctx,[]byte{0,natpmpOpExternalIP},12)
+	if err != nil{
+		return nil,err
+	}
+	return net.IPv4(reply[8],reply[9],reply[10],reply[11]),nil
+}
+
+func (this *NATPMP) AddMapping(ctx context.Context,protocol string,internalPort,externalPort int,
+	lifetime time.Duration) (int,error){
+	reply,err := this.mapping(ctx,protocol,internalPort,externalPort,uint32(lifetime / time.Second))
+	if err != nil{
+		return 0,err
+	}
+	return int(binary.BigEndian.Uint16(reply[10:12])),nil
+}
+
+// DeleteMapping removes the mapping of internalPort; NAT-PMP has no use
+// for externalPort.
+func (this *NATPMP) DeleteMapping(ctx context.Context,protocol string,internalPort,externalPort int) error{
+	_,err := this.mapping(ctx,protocol,internalPort,0,0)
+	return err
+}
+
+func (this *NATPMP) mapping(ctx context.Context,protocol string,internalPort,externalPort int,
+	lifetime uint32) ([]byte,error){
+	var op byte
+	switch protocol {
+	case "udp":
+		op = natpmpOpMapUDP
+	case "tcp":
+		op = natpmpOpMapTCP
+	default:
+		return nil,fmt.Errorf("nat-pmp: unknown protocol %q",protocol)
+	}
+	req := make([]byte,12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6],uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8],uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12],lifetime)
+	return this.request(ctx,req,16)
+}
+
+// request sends req until a reply of at least size bytes comes back,
+// waiting twice as long after each attempt as RFC 6886 asks.
+func (this *NATPMP) request(ctx context.Context,req []byte,size int) ([]byte,error){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	conn,err := net.DialUDP("udp4",nil,this.gateway)
+	if err != nil{
+		return nil,err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx,func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buf := make([]byte,16)
+	wait := natpmpFirstWait
+	for attempt := 0; attempt < natpmpRetries; attempt++{
+		if _,err := conn.Write(req); err != nil{
+			return nil,err
+		}
+		deadline := time.Now().Add(wait)
+		if d,ok := ctx.Deadline(); ok && d.Before(deadline){
+			deadline = d
+		}
+		if err := ctx.Err(); err != nil{
+			return nil,err
+		}
+		_ = conn.SetReadDeadline(deadline)
+		for{
+			n,err := conn.Read(buf)
+			if err != nil{
+				if ctx.Err() != nil{
+					return nil,ctx.Err()
+				}
+				// The read deadline may be the context's, and pass just
+				// before the context notices.
+				if d,ok := ctx.Deadline(); ok && !time.Now().Before(d){
+					return nil,context.DeadlineExceeded
+				}
+				if ne,ok := err.(net.Error); ok && ne.Timeout(){
+					break
+				}
+				return nil,err
+			}
+			if n < size || buf[0] != 0 || buf[1] != req[1] + 128{
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:4]); code != 0{
+				return nil,&NATPMPError{int(code)}
+			}
+			return buf[:n],nil
+		}
+		wait *= 2
+	}
+	return nil,errNATPMPTimeout
+}
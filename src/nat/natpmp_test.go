@@ -0,0 +1,230 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGateway is a NAT-PMP gateway on the loopback interface.
+type testGateway struct {
+	conn		*net.UDPConn
+	external	net.IP
+
+	mu			sync.Mutex
+	drop		int				// requests to ignore before answering
+	code		uint16			// result code of the answers
+	taken		map[int]bool	// external ports mapped by someone else
+	mappings	map[int]testMapping	// by internal port
+	requests	int
+}
+
+type testMapping struct {
+	external	int
+	lifetime	uint32
+}
+
+// newTestGateway starts a gateway, set up by configure if not nil.
+func newTestGateway(t *testing.T,configure func(gw *testGateway)) *testGateway{
+	conn,err := net.ListenUDP("udp4",&net.UDPAddr{IP: net.IPv4(127,0,0,1)})
+	if err != nil{
+		t.Fatal(err)
+	}
+	gw := &testGateway{
+		conn:		conn,
+		external:	net.IPv4(203,0,113,7),
+		taken:		make(map[int]bool),
+		mappings:	make(map[int]testMapping),
+	}
+	if configure != nil{
+		configure(gw)
+	}
+	go gw.serve()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return gw
+}
+
+func (this *testGateway) addr() *net.UDPAddr{
+	return this.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (this *testGateway) mapping(internal int) (testMapping,bool){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	m,ok := this.mappings[internal]
+	return m,ok
+}
+
+func (this *testGateway) requestCount() int{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.requests
+}
+
+func (this *testGateway) serve(){
+	buf := make([]byte,64)
+	for{
+		n,from,err := this.conn.ReadFromUDP(buf)
+		if err != nil{
+			return
+		}
+		if reply := this.handle(buf[:n]); reply != nil{
+			this.conn.WriteToUDP(reply,from)
+		}
+	}
+}
+
+func (this *testGateway) handle(req []byte) []byte{
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.requests++
+	if this.drop > 0{
+		this.drop--
+		return nil
+	}
+	if len(req) < 2 || req[0] != 0{
+		return nil
+	}
+
+	op := req[1]
+	switch {
+	case op == natpmpOpExternalIP && len(req) == 2:
+		reply := make([]byte,12)
+		reply[1] = 128 + op
+		binary.BigEndian.PutUint16(reply[2:4],this.code)
+		copy(reply[8:12],this.external.To4())
+		return reply
+
+	case (op == natpmpOpMapUDP || op == natpmpOpMapTCP) && len(req) == 12:
+		internal := int(binary.BigEndian.Uint16(req[4:6]))
+		external := int(binary.BigEndian.Uint16(req[6:8]))
+		lifetime := binary.BigEndian.Uint32(req[8:12])
+		if lifetime == 0{
+			delete(this.mappings,internal)
+			external = 0
+		}else if m,ok := this.mappings[internal]; ok{
+			external = m.external
+			this.mappings[internal] = testMapping{external,lifetime}
+		}else{
+			for this.taken[external]{
+				external++
+			}
+			this.taken[external] = true
+			this.mappings[internal] = testMapping{external,lifetime}
+		}
+		reply := make([]byte,16)
+		reply[1] = 128 + op
+		binary.BigEndian.PutUint16(reply[2:4],this.code)
+		binary.BigEndian.PutUint16(reply[8:10],uint16(internal))
+		binary.BigEndian.PutUint16(reply[10:12],uint16(external))
+		binary.BigEndian.PutUint32(reply[12:16],lifetime)
+		return reply
+	}
+	return nil
+}
+
+func testContext(t *testing.T) context.Context{
+	ctx,cancel := context.WithTimeout(context.Background(),10 * time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestNATPMPExternalIP(t *testing.T){
+	gw := newTestGateway(t,nil)
+	ip,err := NewNATPMP(gw.addr()).ExternalIP(testContext(t))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !ip.Equal(gw.external){
+		t.Errorf("ExternalIP() = %v, want %v",ip,gw.external)
+	}
+}
+
+func TestNATPMPMapping(t *testing.T){
+	gw := newTestGateway(t,func(gw *testGateway) {
+		gw.taken[6881] = true
+	})
+	pmp := NewNATPMP(gw.addr())
+	ctx := testContext(t)
+
+	// The port we ask for is taken, so the gateway picks another.
+	port,err := pmp.AddMapping(ctx,"udp",6881,6881,time.Hour)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if port != 6882{
+		t.Errorf("mapped port %d, want 6882",port)
+	}
+	if m,_ := gw.mapping(6881); m.external != 6882 || m.lifetime != 3600{
+		t.Errorf("gateway has mapping %+v",m)
+	}
+
+	// Renewing asks for the port we got and keeps it.
+	port,err = pmp.AddMapping(ctx,"udp",6881,port,2 * time.Hour)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if m,_ := gw.mapping(6881); port != 6882 || m.external != 6882 || m.lifetime != 7200{
+		t.Errorf("renewal mapped port %d, gateway has %+v",port,m)
+	}
+
+	if err := pmp.DeleteMapping(ctx,"udp",6881,port); err != nil{
+		t.Fatal(err)
+	}
+	if m,ok := gw.mapping(6881); ok{
+		t.Errorf("mapping %+v left after delete",m)
+	}
+
+	if _,err := pmp.AddMapping(ctx,"sctp",6881,6881,time.Hour); err == nil{
+		t.Error("mapped an unknown protocol")
+	}
+}
+
+func TestNATPMPRetry(t *testing.T){
+	gw := newTestGateway(t,func(gw *testGateway) {
+		gw.drop = 2
+	})
+	if _,err := NewNATPMP(gw.addr()).ExternalIP(testContext(t)); err != nil{
+		t.Fatal(err)
+	}
+	if n := gw.requestCount(); n != 3{
+		t.Errorf("gateway got %d requests, want 3",n)
+	}
+}
+
+func TestNATPMPResultCode(t *testing.T){
+	gw := newTestGateway(t,func(gw *testGateway) {
+		gw.code = 2
+	})
+	_,err := NewNATPMP(gw.addr()).AddMapping(testContext(t),"udp",6881,6881,time.Hour)
+	var pmpErr *NATPMPError
+	if !errors.As(err,&pmpErr) || pmpErr.Code != 2{
+		t.Errorf("got error %v, want result code 2",err)
+	}
+}
+
+func TestNATPMPSilentGateway(t *testing.T){
+	gw := newTestGateway(t,func(gw *testGateway) {
+		gw.drop = 1 << 30
+	})
+	ctx,cancel := context.WithTimeout(context.Background(),600 * time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_,err := NewNATPMP(gw.addr()).ExternalIP(ctx)
+	if err != context.DeadlineExceeded{
+		t.Errorf("got error %v, want %v",err,context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second{
+		t.Errorf("gave up after %v",elapsed)
+	}
+	if n := gw.requestCount(); n < 2{
+		t.Errorf("gateway got %d requests, want retries",n)
+	}
+}
@@ -0,0 +1,317 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr		= "239.255.255.250:1900"
+	ssdpTimeout		= 3 * time.Second
+	maxUPnPBody		= 1 << 20
+
+	// errorCode of gateways that refuse leases other than 0 (permanent)
+	upnpOnlyPermanentLeases	= 725
+)
+
+var igdDevices = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// UPnPError is a SOAP fault returned by the gateway.
+type UPnPError struct {
+	Code		int
+	Description	string
+}
+
+func (this *UPnPError) Error() string{
+	return fmt.Sprintf("upnp: error %d: %s",this.Code,this.Description)
+}
+
+// UPnP is the WANIPConnection or WANPPPConnection service of an Internet
+// Gateway Device.
+type UPnP struct {
+	controlURL	string
+	serviceType	string
+	localIP		net.IP		// our address on the gateway's network
+	client		*http.Client
+}
+
+type upnpRoot struct {
+	URLBase		string		`xml:"URLBase"`
+	Device		upnpDevice	`xml:"device"`
+}
+
+type upnpDevice struct {
+	Services	[]upnpService	`xml:"serviceList>service"`
+	Devices		[]upnpDevice	`xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType	string	`xml:"serviceType"`
+	ControlURL	string	`xml:"controlURL"`
+}
+
+// DiscoverUPnP searches for a gateway by sending an SSDP search to addr,
+// the SSDP multicast group if addr is empty, and returns the first one
+// that offers a WAN connection service.
+func DiscoverUPnP(ctx context.Context,addr string) (*UPnP,error){
+	if addr == ""{
+		addr = ssdpAddr
+	}
+	dst,err := net.ResolveUDPAddr("udp4",addr)
+	if err != nil{
+		return nil,err
+	}
+	conn,err := net.ListenUDP("udp4",nil)
+	if err != nil{
+		return nil,err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(ssdpTimeout)
+	if d,ok := ctx.Deadline(); ok && d.Before(deadline){
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx,func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for _,st := range igdDevices{
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"ST: " + st + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		if _,err := conn.WriteToUDP([]byte(msg),dst); err != nil{
+			return nil,err
+		}
+	}
+
+	tried := make(map[string]bool)
+	buf := make([]byte,2048)
+	var lastErr error = ErrNoGateway
+	for{
+		n,_,err := conn.ReadFromUDP(buf)
+		if err != nil{
+			if ctx.Err() != nil{
+				return nil,ctx.Err()
+			}
+			return nil,lastErr
+		}
+		resp,err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])),nil)
+		if err != nil{
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || tried[location]{
+			continue
+		}
+		tried[location] = true
+		u,err := NewUPnP(ctx,location)
+		if err != nil{
+			lastErr = err
+			continue
+		}
+		return u,nil
+	}
+}
+
+// NewUPnP reads the device description at location and picks its WAN
+// connection service.
+func NewUPnP(ctx context.Context,location string) (*UPnP,error){
+	base,err := url.Parse(location)
+	if err != nil{
+		return nil,err
+	}
+	client := &http.Client{}
+	req,err := http.NewRequestWithContext(ctx,"GET",location,nil)
+	if err != nil{
+		return nil,err
+	}
+	resp,err := client.Do(req)
+	if err != nil{
+		return nil,err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK{
+		return nil,fmt.Errorf("upnp: %s: %s",location,resp.Status)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body,maxUPnPBody)).Decode(&root); err != nil{
+		return nil,err
+	}
+	if root.URLBase != ""{
+		if base,err = url.Parse(root.URLBase); err != nil{
+			return nil,err
+		}
+	}
+
+	service,ok := root.Device.wanService()
+	if !ok{
+		return nil,fmt.Errorf("upnp: %s: no WAN connection service",location)
+	}
+	control,err := base.Parse(service.ControlURL)
+	if err != nil{
+		return nil,err
+	}
+
+	// Our address on the gateway's network is the one we reach it from.
+	host := control.Host
+	if control.Port() == ""{
+		host = net.JoinHostPort(control.Hostname(),"80")
+	}
+	conn,err := net.Dial("udp4",host)
+	if err != nil{
+		return nil,err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	return &UPnP{
+		controlURL:		control.String(),
+		serviceType:	service.ServiceType,
+		localIP:		localIP,
+		client:			client,
+	},nil
+}
+
+// wanService finds a WANIPConnection or WANPPPConnection service in the
+// device tree.
+func (this *upnpDevice) wanService() (upnpService,bool){
+	for _,s := range this.Services{
+		if strings.HasPrefix(s.ServiceType,"urn:schemas-upnp-org:service:WANIPConnection:") ||
+			strings.HasPrefix(s.ServiceType,"urn:schemas-upnp-org:service:WANPPPConnection:"){
+			return s,true
+		}
+	}
+	for i := range this.Devices{
+		if s,ok := this.Devices[i].wanService(); ok{
+			return s,true
+		}
+	}
+	return upnpService{},false
+}
+
+func (this *UPnP) ExternalIP(ctx context.Context) (net.IP,error){
+	reply,err := this.call(ctx,"GetExternalIPAddress",nil)
+	if err != nil{
+		return nil,err
+	}
+	value,_ := soapValue(reply,"NewExternalIPAddress")
+	ip := net.ParseIP(value)
+	if ip == nil{
+		return nil,fmt.Errorf("upnp: bad external address %q",value)
+	}
+	return ip,nil
+}
+
+// AddMapping maps externalPort, which UPnP-IGD cannot change, so it is
+// always the port returned. A gateway that only takes permanent mappings
+// gets one; DeleteMapping must then remove it.
+func (this *UPnP) AddMapping(ctx context.Context,protocol string,internalPort,externalPort int,
+	lifetime time.Duration) (int,error){
+	args := []string{
+		"NewRemoteHost","",
+		"NewExternalPort",strconv.Itoa(externalPort),
+		"NewProtocol",strings.ToUpper(protocol),
+		"NewInternalPort",strconv.Itoa(internalPort),
+		"NewInternalClient",this.localIP.String(),
+		"NewEnabled","1",
+		"NewPortMappingDescription","dht",
+		"NewLeaseDuration",strconv.Itoa(int(lifetime / time.Second)),
+	}
+	_,err := this.call(ctx,"AddPortMapping",args)
+	var upnpErr *UPnPError
+	if errors.As(err,&upnpErr) && upnpErr.Code == upnpOnlyPermanentLeases{
+		args[len(args) - 1] = "0"
+		_,err = this.call(ctx,"AddPortMapping",args)
+	}
+	if err != nil{
+		return 0,err
+	}
+	return externalPort,nil
+}
+
+func (this *UPnP) DeleteMapping(ctx context.Context,protocol string,internalPort,externalPort int) error{
+	_,err := this.call(ctx,"DeletePortMapping",[]string{
+		"NewRemoteHost","",
+		"NewExternalPort",strconv.Itoa(externalPort),
+		"NewProtocol",strings.ToUpper(protocol),
+	})
+	return err
+}
+
+// call invokes action with args, given as name,value pairs, and returns
+// the body of the reply.
+func (this *UPnP) call(ctx context.Context,action string,args []string) ([]byte,error){
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body,`<u:%s xmlns:u="%s">`,action,this.serviceType)
+	for i := 0; i + 1 < len(args); i += 2{
+		fmt.Fprintf(&body,"<%s>",args[i])
+		_ = xml.EscapeText(&body,[]byte(args[i + 1]))
+		fmt.Fprintf(&body,"</%s>",args[i])
+	}
+	fmt.Fprintf(&body,`</u:%s></s:Body></s:Envelope>`,action)
+
+	req,err := http.NewRequestWithContext(ctx,"POST",this.controlURL,&body)
+	if err != nil{
+		return nil,err
+	}
+	req.Header.Set("Content-Type",`text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction",`"` + this.serviceType + "#" + action + `"`)
+	resp,err := this.client.Do(req)
+	if err != nil{
+		return nil,err
+	}
+	defer resp.Body.Close()
+	reply,err := io.ReadAll(io.LimitReader(resp.Body,maxUPnPBody))
+	if err != nil{
+		return nil,err
+	}
+
+	if resp.StatusCode != http.StatusOK{
+		if code,ok := soapValue(reply,"errorCode"); ok{
+			n,_ := strconv.Atoi(code)
+			description,_ := soapValue(reply,"errorDescription")
+			return nil,&UPnPError{n,description}
+		}
+		return nil,fmt.Errorf("upnp: %s: %s",action,resp.Status)
+	}
+	return reply,nil
+}
+
+// soapValue returns the text of the first element called name in data.
+func soapValue(data []byte,name string) (string,bool){
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for{
+		tok,err := d.Token()
+		if err != nil{
+			return "",false
+		}
+		if start,ok := tok.(xml.StartElement); ok && start.Name.Local == name{
+			var value string
+			if err := d.DecodeElement(&value,&start); err != nil{
+				return "",false
+			}
+			return strings.TrimSpace(value),true
+		}
+	}
+}
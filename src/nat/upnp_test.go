@@ -0,0 +1,289 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// testDescription nests the WAN connection service two devices deep, as
+// real gateways do, with a control URL relative to the description.
+const testDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+	<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+	<serviceList><service>
+		<serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+		<controlURL>/l3f</controlURL>
+	</service></serviceList>
+	<deviceList><device>
+		<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+		<deviceList><device>
+			<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+			<serviceList><service>
+				<serviceType>` + testServiceType + `</serviceType>
+				<controlURL>ctl/ipconn</controlURL>
+			</service></serviceList>
+		</device></deviceList>
+	</device></deviceList>
+</device>
+</root>`
+
+// testIGD is an Internet Gateway Device: its description and SOAP control
+// are served over HTTP, and it answers SSDP searches on the loopback
+// interface.
+type testIGD struct {
+	http		*httptest.Server
+	ssdp		*net.UDPConn
+
+	mu				sync.Mutex
+	permanentOnly	bool						// refuses leases but 0, with error 725
+	mappings		map[string]map[string]string	// arguments by "protocol port"
+	actions			[]string
+}
+
+// newTestIGD starts a gateway, set up by configure if not nil.
+func newTestIGD(t *testing.T,configure func(igd *testIGD)) *testIGD{
+	igd := &testIGD{mappings: make(map[string]map[string]string)}
+	if configure != nil{
+		configure(igd)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml",func(w http.ResponseWriter,r *http.Request) {
+		io.WriteString(w,testDescription)
+	})
+	mux.HandleFunc("/ctl/ipconn",igd.control)
+	igd.http = httptest.NewServer(mux)
+	t.Cleanup(igd.http.Close)
+
+	conn,err := net.ListenUDP("udp4",&net.UDPAddr{IP: net.IPv4(127,0,0,1)})
+	if err != nil{
+		t.Fatal(err)
+	}
+	igd.ssdp = conn
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go igd.serveSSDP()
+	return igd
+}
+
+func (this *testIGD) serveSSDP(){
+	buf := make([]byte,2048)
+	for{
+		n,from,err := this.ssdp.ReadFromUDP(buf)
+		if err != nil{
+			return
+		}
+		req := string(buf[:n])
+		if !strings.HasPrefix(req,"M-SEARCH * HTTP/1.1\r\n") ||
+			!strings.Contains(req,"\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"){
+			continue
+		}
+		// a stray answer first, which discovery must skip
+		this.ssdp.WriteToUDP([]byte("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n"),from)
+		this.ssdp.WriteToUDP([]byte("HTTP/1.1 200 OK\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + this.http.URL + "/desc.xml\r\n\r\n"),from)
+	}
+}
+
+func (this *testIGD) control(w http.ResponseWriter,r *http.Request){
+	body,_ := io.ReadAll(r.Body)
+	prefix := `"` + testServiceType + "#"
+	action := strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("SOAPAction"),prefix),`"`)
+	arg := func(name string) string{
+		v,_ := soapValue(body,name)
+		return v
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.actions = append(this.actions,action)
+	key := arg("NewProtocol") + " " + arg("NewExternalPort")
+
+	switch action {
+	case "GetExternalIPAddress":
+		soapReply(w,action,"<NewExternalIPAddress>198.51.100.4</NewExternalIPAddress>")
+	case "AddPortMapping":
+		if this.permanentOnly && arg("NewLeaseDuration") != "0"{
+			soapFault(w,upnpOnlyPermanentLeases,"OnlyPermanentLeasesSupported")
+			return
+		}
+		args := make(map[string]string)
+		for _,name := range []string{"NewInternalPort","NewInternalClient","NewEnabled","NewLeaseDuration"}{
+			args[name] = arg(name)
+		}
+		this.mappings[key] = args
+		soapReply(w,action,"")
+	case "DeletePortMapping":
+		if _,ok := this.mappings[key]; !ok{
+			soapFault(w,714,"NoSuchEntryInArray")
+			return
+		}
+		delete(this.mappings,key)
+		soapReply(w,action,"")
+	default:
+		soapFault(w,401,"Invalid Action")
+	}
+}
+
+func (this *testIGD) mapping(key string) (map[string]string,bool){
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	m,ok := this.mappings[key]
+	return m,ok
+}
+
+func soapReply(w http.ResponseWriter,action,values string){
+	fmt.Fprintf(w,`<?xml version="1.0"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action,testServiceType,values,action)
+}
+
+func soapFault(w http.ResponseWriter,code int,description string){
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w,`<?xml version="1.0"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+		`<errorCode>%d</errorCode><errorDescription>%s</errorDescription>`+
+		`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`,code,description)
+}
+
+func discoverTestIGD(t *testing.T,igd *testIGD) *UPnP{
+	t.Helper()
+	u,err := DiscoverUPnP(testContext(t),igd.ssdp.LocalAddr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUPnPDiscover(t *testing.T){
+	igd := newTestIGD(t,nil)
+	u := discoverTestIGD(t,igd)
+	if want := igd.http.URL + "/ctl/ipconn"; u.controlURL != want{
+		t.Errorf("control URL %q, want %q",u.controlURL,want)
+	}
+	if u.serviceType != testServiceType{
+		t.Errorf("service type %q, want %q",u.serviceType,testServiceType)
+	}
+	if !u.localIP.Equal(net.IPv4(127,0,0,1)){
+		t.Errorf("local IP %v, want 127.0.0.1",u.localIP)
+	}
+}
+
+func TestUPnPDiscoverSilence(t *testing.T){
+	conn,err := net.ListenUDP("udp4",&net.UDPAddr{IP: net.IPv4(127,0,0,1)})
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx,cancel := context.WithTimeout(context.Background(),500 * time.Millisecond)
+	defer cancel()
+
+	// The read deadline and the context expire together, so either error
+	// may be reported.
+	start := time.Now()
+	if _,err := DiscoverUPnP(ctx,conn.LocalAddr().String()); err != ErrNoGateway && err != context.DeadlineExceeded{
+		t.Errorf("got error %v, want no gateway found",err)
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second{
+		t.Errorf("gave up after %v",elapsed)
+	}
+}
+
+func TestUPnPExternalIP(t *testing.T){
+	u := discoverTestIGD(t,newTestIGD(t,nil))
+	ip,err := u.ExternalIP(testContext(t))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(198,51,100,4)){
+		t.Errorf("ExternalIP() = %v, want 198.51.100.4",ip)
+	}
+}
+
+func TestUPnPMapping(t *testing.T){
+	igd := newTestIGD(t,nil)
+	u := discoverTestIGD(t,igd)
+	ctx := testContext(t)
+
+	port,err := u.AddMapping(ctx,"udp",6881,7000,time.Hour)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if port != 7000{
+		t.Errorf("mapped port %d, want 7000",port)
+	}
+	m,ok := igd.mapping("UDP 7000")
+	if !ok{
+		t.Fatal("gateway has no mapping")
+	}
+	want := map[string]string{
+		"NewInternalPort":		"6881",
+		"NewInternalClient":	"127.0.0.1",
+		"NewEnabled":			"1",
+		"NewLeaseDuration":		"3600",
+	}
+	for name,v := range want{
+		if m[name] != v{
+			t.Errorf("%s = %q, want %q",name,m[name],v)
+		}
+	}
+
+	// Renewing maps the same port again.
+	if port,err := u.AddMapping(ctx,"udp",6881,port,2 * time.Hour); err != nil || port != 7000{
+		t.Fatalf("renewal: port %d, error %v",port,err)
+	}
+	if m,_ := igd.mapping("UDP 7000"); m["NewLeaseDuration"] != "7200"{
+		t.Errorf("renewed lease %q, want 7200",m["NewLeaseDuration"])
+	}
+
+	if err := u.DeleteMapping(ctx,"udp",6881,port); err != nil{
+		t.Fatal(err)
+	}
+	if _,ok := igd.mapping("UDP 7000"); ok{
+		t.Error("mapping left after delete")
+	}
+
+	// Faults come back as UPnPErrors.
+	err = u.DeleteMapping(ctx,"udp",6881,port)
+	var upnpErr *UPnPError
+	if !errors.As(err,&upnpErr) || upnpErr.Code != 714{
+		t.Errorf("deleting twice: got %v, want error 714",err)
+	}
+}
+
+func TestUPnPPermanentLease(t *testing.T){
+	igd := newTestIGD(t,func(igd *testIGD) {
+		igd.permanentOnly = true
+	})
+	u := discoverTestIGD(t,igd)
+
+	if _,err := u.AddMapping(testContext(t),"tcp",6881,6881,time.Hour); err != nil{
+		t.Fatal(err)
+	}
+	if m,ok := igd.mapping("TCP 6881"); !ok || m["NewLeaseDuration"] != "0"{
+		t.Errorf("gateway has mapping %v, want a permanent one",m)
+	}
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	if got := strings.Join(igd.actions,","); got != "AddPortMapping,AddPortMapping"{
+		t.Errorf("actions %s, want a refused then a permanent AddPortMapping",got)
+	}
+}